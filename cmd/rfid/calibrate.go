@@ -0,0 +1,278 @@
+/*
+The calibrate command estimates per-reader signal corrections from pings
+whose room is known, and writes them to a calibration file that can be
+given to the ingest command.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kshedden/rfid/rfid"
+)
+
+// calibrationSource decides whether a ping from one raw data row was received by a
+// reader in the room where the tag is known to be.  An error is returned if the row
+// can't be parsed.
+type calibrationSource func(fields []string, site *rfid.SiteConfig) (bool, error)
+
+// referenceSource returns a source that uses the pings of stationary reference tags.
+func referenceSource(tags []*rfid.ReferenceTag) calibrationSource {
+
+	rooms := make(map[string]string)
+	for _, tag := range tags {
+		rooms[tag.Tag] = tag.Room
+	}
+
+	return func(f []string, site *rfid.SiteConfig) (bool, error) {
+
+		room, ok := rooms[f[2]]
+		if !ok {
+			return false, nil
+		}
+
+		t, err := rfid.ParseTimeStamp(f[3])
+		if err != nil {
+			return false, err
+		}
+
+		c, ok := site.RoomCode(f[1], t)
+		return ok && site.RoomName(c) == room, nil
+	}
+}
+
+// claritySource returns a source that uses the pings of patients during the given
+// time after their Clarity check-in, when they are assumed to be in an admin room,
+// and during the given time before their check-out, when they are assumed to be in
+// a checkout room.
+func claritySource(window time.Duration) calibrationSource {
+
+	var rfi rfid.RFIDinfo
+
+	return func(f []string, site *rfid.SiteConfig) (bool, error) {
+
+		r := new(rfid.RFIDrecord)
+		if err := r.Parse(f, site, &rfi); err != nil {
+			return false, err
+		}
+		if r.PersonCat != rfid.Patient {
+			return false, nil
+		}
+
+		cr := findClarity(r)
+		if cr == nil {
+			return false, nil
+		}
+
+		switch site.Room(r.IP).Category {
+		case rfid.AdminRoom:
+			return !r.TimeStamp.Before(cr.CheckInTime) && r.TimeStamp.Sub(cr.CheckInTime) <= window, nil
+		case rfid.CheckoutRoom:
+			return !r.TimeStamp.After(cr.CheckOutTime) && cr.CheckOutTime.Sub(r.TimeStamp) <= window, nil
+		default:
+			return false, nil
+		}
+	}
+}
+
+// scanCalibration adds the signals of the pings for one day that are selected by src
+// to cd.  Rows that can't be parsed are reported in the log and counted.
+func scanCalibration(site *rfid.SiteConfig, day time.Time, src calibrationSource, cd *rfid.CalibrationData) error {
+
+	fname := path.Join(site.APDDir, day.Format("2006-01-02")+apdSuffix)
+	logger.Printf("Processing file '%s'", fname)
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+
+	rdr := csv.NewReader(gid)
+	rdr.ReuseRecord = true
+
+	var n, nparse int
+	for {
+		fields, err := rdr.Read()
+		if err == io.EOF {
+			break
+		} else if perr, ok := err.(*csv.ParseError); ok {
+			logger.Printf("%s: %v", fname, perr)
+			nparse++
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", fname, err)
+		}
+
+		// Report a row that can't be parsed
+		invalid := func(err error) {
+			var perr *rfid.ParseError
+			if errors.As(err, &perr) {
+				perr.File = fname
+				perr.Line, _ = rdr.FieldPos(0)
+			}
+			logger.Print(err)
+			nparse++
+		}
+
+		if len(fields) < 6 {
+			invalid(&rfid.ParseError{Field: "row", Value: strings.Join(fields, ","), Err: rfid.ErrFieldCount})
+			continue
+		}
+
+		ok, err := src(fields, site)
+		if err != nil {
+			invalid(err)
+			continue
+		} else if !ok {
+			continue
+		}
+
+		s, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			invalid(&rfid.ParseError{Field: "signal", Value: fields[4], Err: err})
+			continue
+		}
+
+		cd.Add(fields[1], s)
+		n++
+	}
+	logger.Printf("%d pings with known room", n)
+	if nparse > 0 {
+		logger.Printf("%s: %d invalid records", fname, nparse)
+	}
+
+	return nil
+}
+
+// runCalibrate estimates the calibration of the readers of a site using the raw data
+// from start to end (inclusive), and writes it to outfile.  The method is "reference",
+// using the reference tags in reffile, or "clarity", using the Clarity data in indir
+// and the pings within window of check-in and check-out.
+func runCalibrate(site *rfid.SiteConfig, indir, outfile, method, reffile string, window time.Duration, minPings int, start, end time.Time) error {
+
+	var src calibrationSource
+	switch method {
+	case "reference":
+		if reffile == "" {
+			return fmt.Errorf("the reference method requires -ref")
+		}
+		tags, err := rfid.LoadReferenceTags(reffile, site)
+		if err != nil {
+			return err
+		}
+		src = referenceSource(tags)
+	case "clarity":
+		if err := readClarity(indir); err != nil {
+			return err
+		}
+		src = claritySource(window)
+	default:
+		return fmt.Errorf("invalid calibration method '%s'", method)
+	}
+
+	logger = log.New(os.Stderr, "", 0)
+
+	days, _, err := findDays(site, start, end)
+	if err != nil {
+		return fmt.Errorf("site %s: %w", site.Name, err)
+	}
+
+	cd := rfid.NewCalibrationData()
+	var nskip int
+	for _, day := range days {
+		if err := scanCalibration(site, day, src, cd); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping file: %v\n", err)
+			nskip++
+		}
+	}
+
+	cal := cd.Estimate(site.Name, method, minPings)
+	fmt.Printf("%d readers calibrated\n", len(cal.Readers))
+
+	fid, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	if err := cal.Write(fid); err != nil {
+		return err
+	}
+	if err := fid.Close(); err != nil {
+		return err
+	}
+
+	if nskip > 0 {
+		return fmt.Errorf("calibrate: %d files skipped: %w", nskip, errSkipped)
+	}
+
+	return nil
+}
+
+// setupCalibrations reads calibration files and attaches each to the configuration
+// of its site.
+func setupCalibrations(fnames []string) error {
+
+	seen := make(map[string]bool)
+	for _, fname := range fnames {
+
+		cal, err := rfid.LoadCalibration(fname)
+		if err != nil {
+			return err
+		}
+
+		site, ok := sites[cal.Site]
+		if !ok {
+			return fmt.Errorf("%s: unknown site '%s'", fname, cal.Site)
+		}
+		if seen[cal.Site] {
+			return fmt.Errorf("%s: duplicate calibration for site '%s'", fname, cal.Site)
+		}
+		seen[cal.Site] = true
+
+		if err := site.SetCalibration(cal); err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+	}
+
+	return nil
+}
+
+func calibrateCommand(args []string) {
+
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	sitename := fs.String("site", "site.json", "site configuration file")
+	indir := fs.String("in", ".", "directory containing clarity.gob.gz, for the clarity method")
+	outfile := fs.String("out", "calibration.json", "calibration file to write")
+	method := fs.String("method", "reference", "source of pings with known rooms: reference or clarity")
+	reffile := fs.String("ref", "", "JSON file listing the reference tags and their rooms, for the reference method")
+	window := fs.Duration("clarity-window", 2*time.Minute, "use patient pings this long after check-in and before check-out, for the clarity method")
+	minPings := fs.Int("min-pings", 50, "only calibrate readers with at least this many pings")
+	start := fs.String("start", "", "first day to use, YYYY-MM-DD (default first file present)")
+	end := fs.String("end", "", "last day to use, YYYY-MM-DD (default last file present)")
+	fs.Parse(args)
+
+	t0, err := parseDate(*start)
+	check(err)
+	t1, err := parseDate(*end)
+	check(err)
+
+	check(setupSites([]string{*sitename}))
+	check(runCalibrate(siteList[0], *indir, *outfile, *method, *reffile, *window, *minPings, t0, t1))
+}
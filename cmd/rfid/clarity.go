@@ -0,0 +1,243 @@
+/*
+The clarity command creates a gob of Clarity records, sorted by CSN.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/transform"
+
+	"github.com/kshedden/rfid/rfid"
+)
+
+var (
+	recs []*rfid.ClarityRecord
+)
+
+// The clarity files use ' instead of " for quoted fields.  Create a
+// text.Transformer to replace the single quotes with double quotes.
+type fixquote struct{}
+
+func (f *fixquote) Reset() {}
+
+func (f *fixquote) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+
+	for i := range src {
+		if src[i] == '\'' {
+			dst[i] = '"'
+		} else {
+			dst[i] = src[i]
+		}
+	}
+
+	if atEOF {
+		err = io.EOF
+	}
+
+	return len(src), len(src), err
+}
+
+// clarityTimeFormat is the layout of the check in and check out times.
+const clarityTimeFormat = "2006-Jan-02 15:04:05"
+
+// doFile reads the Clarity records from one file.  Records that can't be parsed
+// are reported and skipped, and the number of skipped records is returned.
+func doFile(site *rfid.SiteConfig, fname string) (int, error) {
+
+	fname = path.Join(site.ClarityDir, fname)
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer fid.Close()
+
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", fname, err)
+	}
+	defer gid.Close()
+
+	xid := transform.NewReader(gid, &fixquote{})
+
+	rdr := csv.NewReader(xid)
+	rdr.FieldsPerRecord = -1
+
+	head, err := rdr.Read()
+	if err != nil {
+		return 0, fmt.Errorf("can't read header from '%s': %w", fname, err)
+	}
+	cinf, err := rfid.GetClarityFileInfo(head)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", fname, err)
+	}
+
+	// Report a field that can't be parsed
+	var nskip int
+	skip := func(rec []string, col int, field string, err error) {
+		line, _ := rdr.FieldPos(col)
+		perr := &rfid.ParseError{File: fname, Line: line, Field: field, Value: rec[col], Err: err}
+		fmt.Fprintf(os.Stderr, "%v\n", perr)
+		nskip++
+	}
+
+	for {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		} else if _, ok := err.(*csv.ParseError); ok {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fname, err)
+			nskip++
+			continue
+		} else if err != nil {
+			return nskip, fmt.Errorf("%s: %w", fname, err)
+		}
+
+		if len(rec) != len(head) {
+			line, _ := rdr.FieldPos(0)
+			fmt.Fprintf(os.Stderr, "%s:%d: %d fields, expected %d\n", fname, line, len(rec), len(head))
+			nskip++
+			continue
+		}
+
+		for k, v := range rec {
+			rec[k] = strings.Replace(v, "'", "", -1)
+		}
+
+		cr := new(rfid.ClarityRecord)
+		cr.Site = site.Name
+
+		// Parse the CSN
+		cr.CSN, err = strconv.ParseUint(rec[cinf.CSN], 10, 64)
+		if err != nil {
+			skip(rec, cinf.CSN, "PAT_ENC_CSN_ID", err)
+			continue
+		}
+
+		// Parse the check in time
+		if len(rec[cinf.CheckInTime]) == 0 {
+			continue
+		}
+		cr.CheckInTime, err = time.Parse(clarityTimeFormat, rec[cinf.CheckInTime])
+		if err != nil {
+			skip(rec, cinf.CheckInTime, "CHECKIN_DTTM", err)
+			continue
+		}
+
+		// Parse the check out time
+		if len(rec[cinf.CheckOutTime]) == 0 {
+			continue
+		}
+		cr.CheckOutTime, err = time.Parse(clarityTimeFormat, rec[cinf.CheckOutTime])
+		if err != nil {
+			skip(rec, cinf.CheckOutTime, "CHECKOUT_DTTM", err)
+			continue
+		}
+
+		cr.ProvName = rec[cinf.ProvName]
+
+		cr.VfiOs, err = strconv.ParseFloat(rec[cinf.VfiOs], 64)
+		if err != nil {
+			cr.VfiOs = math.NaN()
+		}
+
+		recs = append(recs, cr)
+	}
+
+	return nskip, nil
+}
+
+type ByCSN []*rfid.ClarityRecord
+
+func (a ByCSN) Len() int           { return len(a) }
+func (a ByCSN) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByCSN) Less(i, j int) bool { return a[i].CSN < a[j].CSN }
+
+// runClarity reads the Clarity extracts of all sites and writes clarity.gob.gz
+// to the output directory.  Files and records that can't be read are reported
+// and skipped, and the returned error then wraps errSkipped.
+func runClarity(outdir string) error {
+
+	recs = recs[0:0]
+
+	var nfile, nrec int
+	for _, site := range siteList {
+
+		fnames, err := ioutil.ReadDir(site.ClarityDir)
+		if err != nil {
+			return err
+		}
+
+		for _, finf := range fnames {
+
+			fname := finf.Name()
+
+			if !strings.HasPrefix(fname, "CSN_SUMMARY") {
+				continue
+			}
+
+			n, err := doFile(site, fname)
+			nrec += n
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping file: %v\n", err)
+				nfile++
+			}
+		}
+	}
+
+	sort.Stable(ByCSN(recs))
+
+	fname := path.Join(outdir, "clarity.gob.gz")
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	gid := gzip.NewWriter(fid)
+
+	enc := gob.NewEncoder(gid)
+	if err := enc.Encode(recs); err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+
+	if err := gid.Close(); err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+	if err := fid.Close(); err != nil {
+		return err
+	}
+
+	if nfile > 0 || nrec > 0 {
+		return fmt.Errorf("clarity: %d files and %d records skipped: %w", nfile, nrec, errSkipped)
+	}
+
+	return nil
+}
+
+func clarityCommand(args []string) {
+
+	fs := flag.NewFlagSet("clarity", flag.ExitOnError)
+	var sitenames siteFlag
+	fs.Var(&sitenames, "site", "site configuration file, may be repeated (default site.json)")
+	outdir := fs.String("out", ".", "directory for the output file")
+	fs.Parse(args)
+
+	check(setupSites(sitenames))
+	check(runClarity(*outdir))
+}
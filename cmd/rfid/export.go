@@ -0,0 +1,234 @@
+/*
+The export command converts the matched locations to one csv file for each person
+type.  The locations of one patient, provider or tag can be exported on their own,
+reading only the days that contain them.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kshedden/rfid/rfid"
+	"github.com/kshedden/rfid/store"
+)
+
+// exportIDs selects the locations to export by CSN, UMid or tag id, using the index
+// of the store so that only the partitions holding them are read.  Identifiers that
+// are zero are not used, and all locations are exported if all of them are zero.
+type exportIDs struct {
+	csn   uint64
+	umid  uint64
+	tagid uint64
+}
+
+// any returns true if some locations are selected by identifier.
+func (ids *exportIDs) any() bool {
+	return ids != nil && (ids.csn != 0 || ids.umid != 0 || ids.tagid != 0)
+}
+
+// lookup returns the selected locations from a store.
+func (ids *exportIDs) lookup(s *store.Store) ([]*rfid.Location, error) {
+
+	var locs []*rfid.Location
+	var err error
+	switch {
+	case ids.csn != 0:
+		locs, err = s.ByCSN(ids.csn)
+	case ids.umid != 0:
+		locs, err = s.ByUMid(ids.umid)
+	default:
+		locs, err = s.ByTagId(ids.tagid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the locations that match all of the given identifiers
+	var sel []*rfid.Location
+	for _, loc := range locs {
+		if (ids.csn == 0 || loc.CSN == ids.csn) && (ids.umid == 0 || loc.UMid == ids.umid) &&
+			(ids.tagid == 0 || loc.TagId == ids.tagid) {
+			sel = append(sel, loc)
+		}
+	}
+
+	return sel, nil
+}
+
+// runExport converts the matched locations for one person type from indir to a csv
+// file in outdir.  The partitions of the store are read in order of day and site, one
+// location at a time.  If ids selects some locations, only those are exported.
+func runExport(indir, outdir string, person personType, ids *exportIDs) error {
+
+	s, err := store.Open(locDir(indir, person, "_sm"))
+	if err != nil {
+		return err
+	}
+
+	outn := path.Join(outdir, fmt.Sprintf("%s_locations_sm.csv.gz", personName(person)))
+	outf, err := os.Create(outn)
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+	outz := gzip.NewWriter(outf)
+	outc := csv.NewWriter(outz)
+
+	fields := []string{"Site", "TagID", "Time", "CSN", "Room1", "Room2", "Person", "Provider", "UMid",
+		"Signal1", "Signal2", "Room_Shares", "Room_HMM", "Post_HMM", "Room2_HMM", "Post2_HMM", "Entropy_HMM", "Match"}
+	if err := outc.Write(fields); err != nil {
+		return fmt.Errorf("%s: %w", outn, err)
+	}
+
+	write := func(r *rfid.Location) error {
+		fields, err := exportRecord(r)
+		if err != nil {
+			return err
+		}
+		if err := outc.Write(fields); err != nil {
+			return fmt.Errorf("%s: %w", outn, err)
+		}
+		return nil
+	}
+
+	if ids.any() {
+		locs, err := ids.lookup(s)
+		if err != nil {
+			return err
+		}
+		for _, r := range locs {
+			if err := write(r); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, p := range s.Partitions() {
+			if err := exportPartition(s, p, write); err != nil {
+				return err
+			}
+		}
+	}
+
+	outc.Flush()
+	if err := outc.Error(); err != nil {
+		return fmt.Errorf("%s: %w", outn, err)
+	}
+	if err := outz.Close(); err != nil {
+		return fmt.Errorf("%s: %w", outn, err)
+	}
+
+	return outf.Close()
+}
+
+// exportPartition passes the locations in one partition of a store to write, one at a
+// time.
+func exportPartition(s *store.Store, p store.Partition, write func(*rfid.Location) error) error {
+
+	rd, err := s.OpenPartition(p)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	for {
+		r, err := rd.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := write(r); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+}
+
+// exportRecord returns the csv fields for one location.
+func exportRecord(r *rfid.Location) ([]string, error) {
+
+	site, ok := sites[r.Site]
+	if !ok {
+		return nil, fmt.Errorf("no configuration for site '%s'", r.Site)
+	}
+
+	fields := []string{r.Site}
+	fields = append(fields, fmt.Sprintf("%d", r.TagId))
+	fields = append(fields, fmt.Sprintf("%s", r.TimeStamp.Format("2006-01-02T15:04:05")))
+	fields = append(fields, fmt.Sprintf("%d", r.CSN))
+	fields = append(fields, site.RoomName(r.IP))
+	fields = append(fields, site.RoomName(r.IP2))
+
+	if r.PersonCat == rfid.Patient {
+		fields = append(fields, "Patient")
+	} else {
+		fields = append(fields, "Provider")
+	}
+
+	fields = append(fields, rfid.ProvMap[r.ProviderCat])
+	fields = append(fields, fmt.Sprintf("%d", r.UMid))
+
+	fields = append(fields, fmt.Sprintf("%f", r.Signal))
+	fields = append(fields, fmt.Sprintf("%f", r.Signal2))
+	fields = append(fields, roomShares(site, r.Signals))
+
+	fields = append(fields, site.RoomName(r.IPhmm))
+	fields = append(fields, fmt.Sprintf("%f", r.PostHMM))
+	fields = append(fields, site.RoomName(r.IPhmm2))
+	fields = append(fields, fmt.Sprintf("%f", r.PostHMM2))
+	fields = append(fields, fmt.Sprintf("%f", r.EntropyHMM))
+
+	if r.Match {
+		fields = append(fields, "T")
+	} else {
+		fields = append(fields, "F")
+	}
+
+	return fields, nil
+}
+
+func exportCommand(args []string) {
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var sitenames siteFlag
+	fs.Var(&sitenames, "site", "site configuration file, may be repeated (default site.json)")
+	indir := fs.String("in", ".", "directory containing the matched locations")
+	outdir := fs.String("out", ".", "directory for the csv files")
+	person := fs.String("person", "all", "person type to export: patient, provider or all")
+	ids := new(exportIDs)
+	fs.Uint64Var(&ids.csn, "csn", 0, "export only the locations with this CSN")
+	fs.Uint64Var(&ids.umid, "umid", 0, "export only the locations with this UMid")
+	fs.Uint64Var(&ids.tagid, "tag", 0, "export only the locations with this tag id")
+	fs.Parse(args)
+
+	pts, err := personTypes(*person)
+	check(err)
+	check(setupSites(sitenames))
+
+	for _, pt := range pts {
+		check(runExport(*indir, *outdir, pt, ids))
+	}
+}
+
+// roomShares formats the ranked rooms of a location and their shares of the signal,
+// e.g. "Exam1:0.823;Exam2:0.177".
+func roomShares(site *rfid.SiteConfig, rs []rfid.RoomSignal) string {
+
+	var b strings.Builder
+	for i, x := range rs {
+		if i > 0 {
+			b.WriteString(";")
+		}
+		fmt.Fprintf(&b, "%s:%.3f", site.RoomName(x.Room), x.Share)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,656 @@
+/*
+The ingest command reads the raw RFID pings for a range of dates, and
+assigns a location to each tag within each minute.  The locations are
+written to a store for each person type, partitioned by site and day.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kshedden/rfid/rfid"
+	"github.com/kshedden/rfid/store"
+)
+
+var (
+
+	// All the Clarity records
+	clarity []*rfid.ClarityRecord
+
+	logger *log.Logger
+)
+
+type byTime []*rfid.RFIDrecord
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTime) Less(i, j int) bool { return a[i].TimeStamp.Before(a[j].TimeStamp) }
+
+// apdSuffix is the end of the name of every raw data file, which starts with the date.
+const apdSuffix = "_APD.csv.gz"
+
+// findDays returns the days from start to end (inclusive) for which the site has a raw
+// data file, and the days in the same range with no data file.  If start or end is zero,
+// the range is bounded by the first or last file present.
+func findDays(site *rfid.SiteConfig, start, end time.Time) ([]time.Time, []time.Time, error) {
+
+	if _, err := os.Stat(site.APDDir); err != nil {
+		return nil, nil, err
+	}
+
+	fnames, err := filepath.Glob(path.Join(site.APDDir, "*"+apdSuffix))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := make(map[time.Time]bool)
+	var first, last time.Time
+	for _, fname := range fnames {
+
+		day, err := time.Parse("2006-01-02", strings.TrimSuffix(path.Base(fname), apdSuffix))
+		if err != nil {
+			logger.Printf("Skipping file '%s' with no date", fname)
+			continue
+		}
+
+		if (!start.IsZero() && day.Before(start)) || (!end.IsZero() && day.After(end)) {
+			continue
+		}
+
+		present[day] = true
+		if first.IsZero() || day.Before(first) {
+			first = day
+		}
+		if day.After(last) {
+			last = day
+		}
+	}
+
+	if !start.IsZero() {
+		first = start
+	}
+	if !end.IsZero() {
+		last = end
+	}
+
+	var days, missing []time.Time
+	if first.IsZero() || last.IsZero() {
+		return days, missing, nil
+	}
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		if present[day] {
+			days = append(days, day)
+		} else {
+			missing = append(missing, day)
+		}
+	}
+
+	return days, missing, nil
+}
+
+// readDay reads all records for a single day at one site, and returns an RFIDinfo describing
+// the selections, and two RFIDrecord arrays, containing RFIDrecord structs for patients
+// and for providers respectively.  Malformed records are counted in the RFIDinfo, and
+// reported in the log with their line numbers.  An error is returned only if the file
+// can't be read.
+func readDay(site *rfid.SiteConfig, day time.Time) (*rfid.RFIDinfo, []*rfid.RFIDrecord, []*rfid.RFIDrecord, error) {
+
+	fname := path.Join(site.APDDir, day.Format("2006-01-02")+apdSuffix)
+	logger.Print(fmt.Sprintf("Processing file '%s'", fname))
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer fid.Close()
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", fname, err)
+	}
+
+	rdr := csv.NewReader(gid)
+	rdr.ReuseRecord = true
+
+	var patrecs, provrecs []*rfid.RFIDrecord
+	var n int
+	var rfi rfid.RFIDinfo
+	var nerr, nparse int
+	for {
+		fields, err := rdr.Read()
+		if err == io.EOF {
+			break
+		} else if perr, ok := err.(*csv.ParseError); ok {
+			logger.Printf("%s: %v", fname, perr)
+			nerr++
+			continue
+		} else if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %w", fname, err)
+		}
+
+		n++
+
+		r := new(rfid.RFIDrecord)
+		if err := r.Parse(fields, site, &rfi); err != nil {
+			var perr *rfid.ParseError
+			if errors.As(err, &perr) {
+				perr.File = fname
+				perr.Line, _ = rdr.FieldPos(0)
+			}
+			logger.Print(err)
+			nparse++
+			continue
+		}
+
+		// Exclude records when clinic is closed
+		if r.TimeStamp.Hour() < 7 {
+			rfi.TimeEarly++
+			continue
+		}
+		if r.TimeStamp.Hour() > 19 {
+			rfi.TimeLate++
+			continue
+		}
+
+		switch r.PersonCat {
+
+		case rfid.Patient:
+
+			r.Clarity = findClarity(r)
+			if r.Clarity == nil {
+				rfi.NoClarity++
+				continue
+			}
+
+			// Check if the time is prior to the Clarity check-in time
+			if r.TimeStamp.Before(r.Clarity.CheckInTime) {
+				rfi.BeforeCheckIn++
+				continue
+			}
+
+			// Check if the time is after the Clarity check-out time
+			if r.TimeStamp.After(r.Clarity.CheckOutTime) {
+				rfi.AfterCheckOut++
+				continue
+			}
+
+			patrecs = append(patrecs, r)
+
+		case rfid.Provider:
+			provrecs = append(provrecs, r)
+
+		default:
+			return nil, nil, nil, fmt.Errorf("%s: unknown person type %d", fname, r.PersonCat)
+		}
+	}
+
+	if nerr > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d errors parsing csv file, see log for more information\n", fname, nerr)
+	}
+	logger.Printf("%s: %d errors parsing csv file", fname, nerr)
+	if nparse > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d invalid records, see log for more information\n", fname, nparse)
+	}
+	logger.Printf("%s: %d invalid records", fname, nparse)
+
+	// Confirm that it is sorted by time
+	sort.Sort(byTime(provrecs))
+	sort.Sort(byTime(patrecs))
+
+	provrecs = spantime(provrecs, site.NumRooms(), &rfi)
+	patrecs = spantime(patrecs, site.NumRooms(), &rfi)
+
+	rfi.Site = site.Name
+	rfi.Date = day.Format("2006-01-02")
+	rfi.FileName = fname
+	rfi.CSVErrors = nerr
+	rfi.TotalRecs = n
+	rfi.FinalRecs = len(provrecs) + len(patrecs)
+
+	return &rfi, patrecs, provrecs, nil
+}
+
+// dayJob is one day of raw data at one site.
+type dayJob struct {
+	site *rfid.SiteConfig
+	day  time.Time
+}
+
+// dayResult holds the locations for one day at one site.
+type dayResult struct {
+	rfi      *rfid.RFIDinfo
+	patlocs  []*rfid.Location
+	provlocs []*rfid.Location
+	npat     int
+	nprov    int
+	err      error
+}
+
+// ingestDay reads the raw data for one day at one site and locates the tags.
+func ingestDay(job dayJob, lopts *rfid.LocationOptions) *dayResult {
+
+	rfi, patrecs, provrecs, err := readDay(job.site, job.day)
+	if err != nil {
+		return &dayResult{err: err}
+	}
+
+	patlocs, err := rfid.GetLocation(patrecs, job.site, lopts)
+	if err != nil {
+		return &dayResult{err: err}
+	}
+	provlocs, err := rfid.GetLocation(provrecs, job.site, lopts)
+	if err != nil {
+		return &dayResult{err: err}
+	}
+
+	return &dayResult{
+		rfi:      rfi,
+		patlocs:  patlocs,
+		provlocs: provlocs,
+		npat:     len(patrecs),
+		nprov:    len(provrecs),
+	}
+}
+
+// ingestDays processes the jobs using a pool of workers, and calls write with the result
+// of each job, in the order of the jobs.  To bound the memory use, at most two jobs per
+// worker are started before their results are written.  If write returns an error, no
+// more jobs are started and the error is returned.
+func ingestDays(jobs []dayJob, lopts *rfid.LocationOptions, workers int, write func(dayJob, *dayResult) error) error {
+
+	// Each job has its own channel for its result, so that the results can be
+	// taken in order.
+	out := make([]chan *dayResult, len(jobs))
+	for i := range out {
+		out[i] = make(chan *dayResult, 1)
+	}
+
+	// Holds a token for each job that has been started but not written
+	sem := make(chan struct{}, 2*workers)
+	quit := make(chan struct{})
+	next := make(chan int)
+
+	go func() {
+		defer close(next)
+		for i := range jobs {
+			select {
+			case sem <- struct{}{}:
+			case <-quit:
+				return
+			}
+			next <- i
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range next {
+				out[i] <- ingestDay(jobs[i], lopts)
+			}
+		}()
+	}
+
+	for i := range jobs {
+		res := <-out[i]
+		<-sem
+		if err := write(jobs[i], res); err != nil {
+			close(quit)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findClarity returns the Clarity record for the appointment of a patient
+// record, which has the same CSN, site and date, or nil if there is none.
+func findClarity(r *rfid.RFIDrecord) *rfid.ClarityRecord {
+
+	var rec *rfid.ClarityRecord
+	ii := sort.Search(len(clarity), func(i int) bool { return r.CSN <= clarity[i].CSN })
+	for j := ii; j < len(clarity) && clarity[j].CSN == r.CSN; j++ {
+		// We found a CSN match, but also need to check the site and date.
+		if clarity[j].Site != r.Site {
+			continue
+		}
+		if clarity[j].CheckInTime.Truncate(24*time.Hour) == r.TimeStamp.Truncate(24*time.Hour) {
+			rec = clarity[j]
+		}
+	}
+
+	return rec
+}
+
+// spantime removes records from a given IP source if there have
+// already been two records from the same source in the last second.
+// All room codes must be less than nroom.
+func spantime(recs []*rfid.RFIDrecord, nroom int, rfi *rfid.RFIDinfo) []*rfid.RFIDrecord {
+
+	last1 := make([]time.Time, nroom)
+	last2 := make([]time.Time, nroom)
+
+	for k, r := range recs {
+
+		// Initial fill-in of the queues
+		if last1[r.IP].IsZero() {
+			last1[r.IP] = r.TimeStamp
+			continue
+		} else if last2[r.IP].IsZero() {
+			last2[r.IP] = last1[r.IP]
+			last1[r.IP] = r.TimeStamp
+			continue
+		}
+
+		if r.TimeStamp.Sub(last2[r.IP]).Seconds() <= 1 {
+			rfi.TimeSpanFull++
+			recs[k] = nil
+		}
+
+		// Shift down
+		last2[r.IP] = last1[r.IP]
+		last1[r.IP] = r.TimeStamp
+	}
+
+	// Remove the nil values.
+	recx := make([]*rfid.RFIDrecord, len(recs))
+	var i int
+	for _, v := range recs {
+		if v != nil {
+			recx[i] = v
+			i++
+		}
+	}
+	recx = recx[0:i]
+
+	return recx
+}
+
+func readClarity(indir string) error {
+
+	fname := path.Join(indir, "clarity.gob.gz")
+	fid, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+	defer gid.Close()
+
+	dec := gob.NewDecoder(gid)
+
+	if err := dec.Decode(&clarity); err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+
+	return nil
+}
+
+func setupLog(outdir string) error {
+	fid, err := os.Create(path.Join(outdir, "ingest.log"))
+	if err != nil {
+		return err
+	}
+	logger = log.New(fid, "", 0)
+	return nil
+}
+
+// runIngest processes the raw data for all days from start to end (inclusive),
+// reading the Clarity data from indir and writing the locations to outdir, with one
+// store for each person type, partitioned by site and day.  Days with no raw data
+// file are reported, and a zero start or end date includes all files before or after
+// the other bound.  Files that can't be read are reported and skipped, and the
+// returned error then wraps errSkipped.  The days are read and located by a pool of
+// workers, but the locations are written in order of day and site.  If the locations
+// can't all be written, the partial stores are removed.
+func runIngest(indir, outdir string, start, end time.Time, th *rfid.QualityThresholds, lopts *rfid.LocationOptions, workers int) error {
+
+	if err := lopts.Check(); err != nil {
+		return err
+	}
+
+	if workers < 1 {
+		return fmt.Errorf("the number of workers must be positive")
+	}
+
+	if err := setupLog(outdir); err != nil {
+		return err
+	}
+
+	if err := readClarity(indir); err != nil {
+		return err
+	}
+
+	// The stores for the patient and provider locations
+	var outs outputStores
+	defer outs.abort()
+	var stores [2]*store.Writer
+	for j, pt := range []personType{patient, provider} {
+		w, err := outs.create(locDir(outdir, pt, ""))
+		if err != nil {
+			return err
+		}
+		stores[j] = w
+	}
+
+	// The days with data for each site
+	sitedays := make(map[string]map[time.Time]bool)
+	var alldays []time.Time
+	for _, site := range siteList {
+
+		days, missing, err := findDays(site, start, end)
+		if err != nil {
+			return fmt.Errorf("site %s: %w", site.Name, err)
+		}
+
+		for _, day := range missing {
+			msg := fmt.Sprintf("%s %s missing", site.Name, day.Format("2006-01-02"))
+			fmt.Println(msg)
+			logger.Print(msg)
+		}
+		logger.Printf("%s: %d days with data, %d days missing", site.Name, len(days), len(missing))
+
+		sitedays[site.Name] = make(map[time.Time]bool)
+		for _, day := range days {
+			sitedays[site.Name][day] = true
+			alldays = append(alldays, day)
+		}
+	}
+
+	// The data quality information for each site and day
+	var infos []*rfid.RFIDinfo
+
+	// The days in order, over all sites
+	sort.Slice(alldays, func(i, j int) bool { return alldays[i].Before(alldays[j]) })
+	var jobs []dayJob
+	for i, day := range alldays {
+
+		if i > 0 && day.Equal(alldays[i-1]) {
+			continue
+		}
+
+		for _, site := range siteList {
+			if sitedays[site.Name][day] {
+				jobs = append(jobs, dayJob{site: site, day: day})
+			}
+		}
+	}
+
+	var nskip int
+	write := func(job dayJob, res *dayResult) error {
+
+		if res.err != nil {
+			msg := fmt.Sprintf("Skipping file: %v", res.err)
+			fmt.Fprintln(os.Stderr, msg)
+			logger.Print(msg)
+			nskip++
+			return nil
+		}
+		fmt.Printf("%s %s %d %d\n", job.site.Name, job.day.Format("2006-01-02"), res.nprov, res.npat)
+		infos = append(infos, res.rfi)
+		if err := stores[0].Write(job.site.Name, job.day, res.patlocs); err != nil {
+			return err
+		}
+
+		return stores[1].Write(job.site.Name, job.day, res.provlocs)
+	}
+
+	if err := ingestDays(jobs, lopts, workers, write); err != nil {
+		return err
+	}
+	if err := outs.close(); err != nil {
+		return err
+	}
+
+	if err := writeQuality(outdir, infos, th); err != nil {
+		return err
+	}
+
+	if nskip > 0 {
+		return fmt.Errorf("ingest: %d files skipped: %w", nskip, errSkipped)
+	}
+
+	return nil
+}
+
+// qualityReport is the content of the data quality JSON file.
+type qualityReport struct {
+	Thresholds *rfid.QualityThresholds
+	Summary    *rfid.RFIDinfo
+	Days       []*rfid.RFIDinfo
+}
+
+// writeQuality checks each day against the thresholds, and writes the per-day data
+// quality table in csv and json formats to outdir, along with a summary of the run.
+func writeQuality(outdir string, infos []*rfid.RFIDinfo, th *rfid.QualityThresholds) error {
+
+	summary := &rfid.RFIDinfo{Site: "all", Date: "all"}
+	var nflag int
+	for _, rfi := range infos {
+		summary.Add(rfi)
+		if !rfi.Check(th) {
+			nflag++
+			msg := fmt.Sprintf("%s %s flagged: %s", rfi.Site, rfi.Date, strings.Join(rfi.Flags, "; "))
+			fmt.Println(msg)
+			logger.Print(msg)
+		}
+	}
+	summary.Check(th)
+
+	fid, err := os.Create(path.Join(outdir, "quality.csv"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	if err := rfid.WriteQualityCSV(fid, append(infos, summary)); err != nil {
+		return err
+	}
+	if err := fid.Close(); err != nil {
+		return err
+	}
+
+	jid, err := os.Create(path.Join(outdir, "quality.json"))
+	if err != nil {
+		return err
+	}
+	defer jid.Close()
+	enc := json.NewEncoder(jid)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&qualityReport{Thresholds: th, Summary: summary, Days: infos}); err != nil {
+		return err
+	}
+	if err := jid.Close(); err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("%d days, %d records read, %d retained, %.1f%% rejected, %d days flagged",
+		len(infos), summary.TotalRecs, summary.FinalRecs, 100*summary.RejectionRate(), nflag)
+	fmt.Println(msg)
+	logger.Print(msg)
+
+	return nil
+}
+
+// thresholdFlags defines the flags for the data quality thresholds.
+func thresholdFlags(fs *flag.FlagSet) *rfid.QualityThresholds {
+
+	th := new(rfid.QualityThresholds)
+	fs.Float64Var(&th.Rejected, "max-rejected", 0.5, "flag days where a larger fraction of records is rejected (0 to disable)")
+	fs.Float64Var(&th.InvalidIP, "max-invalid-ip", 0.05, "flag days where a larger fraction of records is from unknown readers (0 to disable)")
+	fs.Float64Var(&th.NoClarity, "max-no-clarity", 0.25, "flag days where a larger fraction of records has no Clarity appointment (0 to disable)")
+	fs.Float64Var(&th.InvalidTag, "max-invalid-tag", 0.05, "flag days where a larger fraction of records has an invalid tag (0 to disable)")
+
+	return th
+}
+
+// parseDate parses a date flag formatted as YYYY-MM-DD.  An empty value gives
+// the zero time, meaning that the date range is unbounded.
+func parseDate(value string) (time.Time, error) {
+
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
+
+// locationFlags defines the flags that control how pings are combined into locations.
+func locationFlags(fs *flag.FlagSet) *rfid.LocationOptions {
+
+	lopts := rfid.DefaultLocationOptions()
+	fs.DurationVar(&lopts.Window, "window", lopts.Window, "length of the time windows for locating tags, e.g. 15s, 30s, 1m, 5m")
+	fs.Func("weighting", "how pings from one room are combined: exp, linear, max, reads or trimmed (default exp)", func(s string) error {
+		w, err := rfid.ParseWeighting(s)
+		lopts.Weighting = w
+		return err
+	})
+	fs.IntVar(&lopts.MinPings, "min-pings", lopts.MinPings, "ignore rooms with fewer pings for a tag in a window")
+	fs.Float64Var(&lopts.Trim, "trim", lopts.Trim, "fraction of signals trimmed from each end for the trimmed weighting")
+	fs.IntVar(&lopts.TopK, "top-k", lopts.TopK, "number of ranked rooms kept for each location, 0 for all rooms with a signal")
+
+	return lopts
+}
+
+func ingestCommand(args []string) {
+
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	var sitenames siteFlag
+	fs.Var(&sitenames, "site", "site configuration file, may be repeated (default site.json)")
+	var calnames siteFlag
+	fs.Var(&calnames, "calibration", "reader calibration file written by the calibrate command, may be repeated for several sites")
+	indir := fs.String("in", ".", "directory containing clarity.gob.gz")
+	outdir := fs.String("out", ".", "directory for the output files")
+	start := fs.String("start", "", "first day to process, YYYY-MM-DD (default first file present)")
+	end := fs.String("end", "", "last day to process, YYYY-MM-DD (default last file present)")
+	th := thresholdFlags(fs)
+	lopts := locationFlags(fs)
+	workers := fs.Int("workers", runtime.NumCPU(), "number of days to process concurrently")
+	fs.Parse(args)
+
+	t0, err := parseDate(*start)
+	check(err)
+	t1, err := parseDate(*end)
+	check(err)
+
+	check(setupSites(sitenames))
+	check(setupCalibrations(calnames))
+	check(runIngest(*indir, *outdir, t0, t1, th, lopts, *workers))
+}
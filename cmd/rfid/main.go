@@ -0,0 +1,171 @@
+/*
+rfid runs the steps of the RFID processing pipeline.
+
+Usage:
+
+	rfid <command> [flags]
+
+The commands are:
+
+	clarity   convert the Clarity extracts to a sorted gob file
+	calibrate estimate per-reader signal corrections from pings with known rooms
+	ingest    read the raw RFID pings and assign a location to each tag and minute
+	smooth    smooth the locations using an HMM
+	match     find the minutes where patients and providers are in the same room
+	export    convert the matched locations to csv format
+	run-all   run all of the above steps in sequence
+	repro     run all the steps twice and check that the output files are identical
+
+Run 'rfid <command> -h' for the flags of each command.
+
+The exit status is 0 on success, 1 if the command failed, 2 for an invalid
+command line, and 3 if the command finished but skipped some input files or
+records that could not be processed, which are reported on standard error.
+Some failures have their own exit status: 4 if an input file is missing a
+required column, 5 if a value in an input file could not be parsed, and 6 if
+a model could not be fit because the data have zero probability.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kshedden/rfid/rfid"
+)
+
+// Exit status codes
+const (
+	exitError   = 1 // The command failed
+	exitUsage   = 2 // The command line is invalid
+	exitSkipped = 3 // The command finished, but some of the input could not be processed
+
+	exitMissingColumn = 4 // An input file is missing a required column
+	exitParse         = 5 // A value in an input file could not be parsed
+	exitDegenerate    = 6 // A model could not be fit to the data
+)
+
+// errSkipped is wrapped by errors reporting that a command finished, but
+// skipped some of its input because it could not be processed.
+var errSkipped = errors.New("some input was skipped")
+
+var (
+	// The site configurations, in the order given on the command line
+	siteList []*rfid.SiteConfig
+
+	// The site configurations, indexed by site name
+	sites map[string]*rfid.SiteConfig
+)
+
+// commands maps each subcommand name to the function that runs it.
+var commands = map[string]func(args []string){
+	"clarity":   clarityCommand,
+	"calibrate": calibrateCommand,
+	"ingest":    ingestCommand,
+	"smooth":    smoothCommand,
+	"match":     matchCommand,
+	"export":    exportCommand,
+	"run-all":   runAllCommand,
+	"repro":     reproCommand,
+}
+
+// siteFlag collects the file names given by a repeated flag, such as the site
+// configuration files from one or more -site flags.
+type siteFlag []string
+
+func (s *siteFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *siteFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// setupSites reads the site configurations, using site.json if none are given.
+func setupSites(fnames []string) error {
+
+	if len(fnames) == 0 {
+		fnames = []string{"site.json"}
+	}
+
+	var err error
+	siteList, err = rfid.LoadSiteConfigs(fnames)
+	if err != nil {
+		return err
+	}
+
+	sites = make(map[string]*rfid.SiteConfig)
+	for _, site := range siteList {
+		sites[site.Name] = site
+	}
+
+	return nil
+}
+
+// personTypes returns the person types selected by the -person flag.
+func personTypes(person string) ([]personType, error) {
+
+	switch person {
+	case "patient":
+		return []personType{patient}, nil
+	case "provider":
+		return []personType{provider}, nil
+	case "all":
+		return []personType{patient, provider}, nil
+	default:
+		return nil, fmt.Errorf("invalid person type '%s'", person)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: rfid <command> [flags]\n\n")
+	fmt.Fprintf(os.Stderr, "commands: clarity, calibrate, ingest, smooth, match, export, run-all, repro\n")
+	os.Exit(exitUsage)
+}
+
+// check exits with a message and a non-zero status if err is not nil.
+func check(err error) {
+
+	if err == nil {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "rfid: %v\n", err)
+	os.Exit(exitCode(err))
+}
+
+// exitCode returns the exit status for an error.
+func exitCode(err error) int {
+
+	var perr *rfid.ParseError
+	switch {
+	case errors.Is(err, errSkipped):
+		return exitSkipped
+	case errors.Is(err, rfid.ErrMissingColumn):
+		return exitMissingColumn
+	case errors.As(err, &perr):
+		return exitParse
+	case errors.Is(err, rfid.ErrDegenerateHMM):
+		return exitDegenerate
+	default:
+		return exitError
+	}
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	cmd(os.Args[2:])
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kshedden/rfid/rfid"
+)
+
+func TestExitCode(t *testing.T) {
+
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{errors.New("failed"), exitError},
+		{fmt.Errorf("smooth: 3 sequences not smoothed: %w", errSkipped), exitSkipped},
+		{fmt.Errorf("clarity.csv: %w CSN", rfid.ErrMissingColumn), exitMissingColumn},
+		{fmt.Errorf("reading: %w", &rfid.ParseError{Field: "signal", Err: errors.New("bad")}), exitParse},
+		{fmt.Errorf("training: %w", rfid.ErrDegenerateHMM), exitDegenerate},
+	} {
+		if code := exitCode(c.err); code != c.code {
+			t.Errorf("%v: got exit code %d, expected %d", c.err, code, c.code)
+		}
+	}
+}
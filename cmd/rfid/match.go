@@ -0,0 +1,131 @@
+/*
+The match command assesses for each patient minute whether a provider is present,
+and for each provider whether a patient is present.  The locations for each site and
+day are matched in turn, so only one day of locations is held in memory.
+*/
+
+package main
+
+import (
+	"flag"
+	"sort"
+
+	"github.com/kshedden/rfid/rfid"
+	"github.com/kshedden/rfid/store"
+)
+
+var (
+	// Location records for providers
+	providers []*rfid.Location
+
+	// Location records for patients
+	patients []*rfid.Location
+)
+
+// Enable sorting of locations by time
+type byLocTime []*rfid.Location
+
+func (a byLocTime) Len() int           { return len(a) }
+func (a byLocTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLocTime) Less(i, j int) bool { return a[i].TimeStamp.Before(a[j].TimeStamp) }
+
+// Enable sorting of locations by CSN
+type byCSN []*rfid.Location
+
+func (a byCSN) Len() int           { return len(a) }
+func (a byCSN) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCSN) Less(i, j int) bool { return a[i].CSN < a[j].CSN }
+
+func search() {
+
+	for _, pat := range patients {
+
+		if pat.IPhmm == rfid.NoSignal {
+			continue
+		}
+
+		f := func(j int) bool {
+			return !providers[j].TimeStamp.Before(pat.TimeStamp)
+		}
+
+		ii := sort.Search(len(providers), f)
+
+		if ii == len(providers) || !providers[ii].TimeStamp.Equal(pat.TimeStamp) {
+			continue
+		}
+
+		for k := ii; k < len(providers) && providers[k].TimeStamp.Equal(pat.TimeStamp); k++ {
+			// Room codes are only comparable within a site
+			if pat.Site == providers[k].Site && pat.IPhmm == providers[k].IPhmm {
+				pat.Match = true
+				providers[k].Match = true
+				break
+			}
+		}
+	}
+}
+
+// runMatch reads the smoothed locations from indir, and writes the matched
+// locations to outdir, one partition at a time, sorted by tag id and time.  If
+// the matched locations can't all be written, the partial stores are removed.
+func runMatch(indir, outdir string) error {
+
+	pats, err := store.Open(locDir(indir, patient, "_s"))
+	if err != nil {
+		return err
+	}
+	provs, err := store.Open(locDir(indir, provider, "_s"))
+	if err != nil {
+		return err
+	}
+
+	var outs outputStores
+	defer outs.abort()
+	opats, err := outs.create(locDir(outdir, patient, "_sm"))
+	if err != nil {
+		return err
+	}
+	oprovs, err := outs.create(locDir(outdir, provider, "_sm"))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		patients, providers = nil, nil
+	}()
+
+	for _, p := range unionPartitions(pats, provs) {
+
+		if patients, err = pats.Read(p); err != nil {
+			return err
+		}
+		if providers, err = provs.Read(p); err != nil {
+			return err
+		}
+
+		// Stable, so that ties between providers are broken by tag id
+		sort.Stable(byLocTime(providers))
+		sort.Stable(byCSN(patients))
+
+		search()
+
+		if err := opats.Write(p.Site, p.Day, patients); err != nil {
+			return err
+		}
+		if err := oprovs.Write(p.Site, p.Day, providers); err != nil {
+			return err
+		}
+	}
+
+	return outs.close()
+}
+
+func matchCommand(args []string) {
+
+	fs := flag.NewFlagSet("match", flag.ExitOnError)
+	indir := fs.String("in", ".", "directory containing the smoothed locations")
+	outdir := fs.String("out", ".", "directory for the matched locations")
+	fs.Parse(args)
+
+	check(runMatch(*indir, *outdir))
+}
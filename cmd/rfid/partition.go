@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/kshedden/rfid/store"
+)
+
+// The locations of each kind are kept in a store, partitioned by site and day, so
+// that each step of the pipeline only needs to hold one partition of locations in
+// memory.
+
+// locDir returns the store directory holding the locations for a person type at one
+// step of the pipeline, identified by suffix ("" for unsmoothed, "_s" for smoothed and
+// "_sm" for matched locations).
+func locDir(dir string, person personType, suffix string) string {
+	return path.Join(dir, fmt.Sprintf("%s_locations%s", personName(person), suffix))
+}
+
+// unionPartitions returns the partitions that are in any of the stores, sorted by day
+// and then by site.
+func unionPartitions(stores ...*store.Store) []store.Partition {
+
+	present := make(map[store.Partition]bool)
+	var parts []store.Partition
+	for _, s := range stores {
+		for _, p := range s.Partitions() {
+			if !present[p] {
+				present[p] = true
+				parts = append(parts, p)
+			}
+		}
+	}
+	store.SortPartitions(parts)
+
+	return parts
+}
+
+// outputStores holds the stores written by one step of the pipeline, so that they
+// can be removed if the step fails before they are all closed.  A store without
+// an index can't be opened, so it would only get in the way of the next run.
+type outputStores struct {
+	writers  []*store.Writer
+	complete bool
+}
+
+// create starts a new store in dir.
+func (s *outputStores) create(dir string) (*store.Writer, error) {
+
+	w, err := store.Create(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.writers = append(s.writers, w)
+
+	return w, nil
+}
+
+// close writes the index of each store.
+func (s *outputStores) close() error {
+
+	for _, w := range s.writers {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	s.complete = true
+
+	return nil
+}
+
+// abort removes the stores unless they were all closed, and is deferred by the
+// steps that create stores.
+func (s *outputStores) abort() {
+
+	if s.complete {
+		return
+	}
+	for _, w := range s.writers {
+		w.Abort()
+	}
+}
@@ -0,0 +1,239 @@
+/*
+The repro command checks that the pipeline output is reproducible.  It runs
+every step twice for the same days, in two scratch directories, and compares
+the SHA-256 hashes of the output files.  The hashes can be saved, and compared
+with hashes saved by an earlier run.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kshedden/rfid/rfid"
+)
+
+// errNotReproducible is returned when the output files of two runs differ.
+var errNotReproducible = errors.New("output is not reproducible")
+
+// hashDir returns the hex encoded SHA-256 hash of each file under dir, except for the
+// log files, indexed by the file name relative to dir.
+func hashDir(dir string) (map[string]string, error) {
+
+	hashes := make(map[string]string)
+	err := filepath.WalkDir(dir, func(fname string, d fs.DirEntry, err error) error {
+
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(fname, ".log") {
+			return nil
+		}
+
+		fid, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, fid)
+		fid.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", fname, err)
+		}
+
+		name, err := filepath.Rel(dir, fname)
+		if err != nil {
+			return err
+		}
+		hashes[filepath.ToSlash(name)] = hex.EncodeToString(h.Sum(nil))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// readHashes reads hashes written by writeHashes.
+func readHashes(fname string) (map[string]string, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(fid)
+	for line := 1; scanner.Scan(); line++ {
+		f := strings.Fields(scanner.Text())
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a hash and a file name", fname, line)
+		}
+		hashes[f[1]] = f[0]
+	}
+
+	return hashes, scanner.Err()
+}
+
+// writeHashes writes hashes in the format of sha256sum, sorted by file name.
+func writeHashes(w io.Writer, hashes map[string]string) error {
+
+	var names []string
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s  %s\n", hashes[name], name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compareHashes returns the names of the files that are missing from one of the
+// hash sets, or that have different hashes, sorted by name.
+func compareHashes(h1, h2 map[string]string) []string {
+
+	var diff []string
+	for name, h := range h1 {
+		if h2[name] != h {
+			diff = append(diff, name)
+		}
+	}
+	for name := range h2 {
+		if _, ok := h1[name]; !ok {
+			diff = append(diff, name)
+		}
+	}
+	sort.Strings(diff)
+
+	return diff
+}
+
+// runRepro runs the pipeline twice for the days from start to end, and compares the
+// hashes of the output files.  If savefile is not empty the hashes are written to it,
+// and if reffile is not empty they are also compared with the hashes in that file.
+// The scratch directories are removed unless keep is true.
+func runRepro(start, end time.Time, savefile, reffile string, keep bool, th *rfid.QualityThresholds,
+	lopts *rfid.LocationOptions, opts *smoothOptions) error {
+
+	var hashes [2]map[string]string
+	var skipped error
+	for i := range hashes {
+
+		dir, err := os.MkdirTemp("", "rfid-repro-")
+		if err != nil {
+			return err
+		}
+		if keep {
+			fmt.Fprintf(os.Stderr, "Run %d is in '%s'\n", i+1, dir)
+		} else {
+			defer os.RemoveAll(dir)
+		}
+
+		err = runPipeline(dir, start, end, th, lopts, opts)
+		if errors.Is(err, errSkipped) {
+			skipped = err
+		} else if err != nil {
+			return err
+		}
+
+		if hashes[i], err = hashDir(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := writeHashes(os.Stdout, hashes[0]); err != nil {
+		return err
+	}
+
+	if diff := compareHashes(hashes[0], hashes[1]); len(diff) > 0 {
+		return fmt.Errorf("files differ between runs: %s: %w", strings.Join(diff, ", "), errNotReproducible)
+	}
+
+	if savefile != "" {
+		fid, err := os.Create(savefile)
+		if err != nil {
+			return err
+		}
+		defer fid.Close()
+		if err := writeHashes(fid, hashes[0]); err != nil {
+			return err
+		}
+		if err := fid.Close(); err != nil {
+			return err
+		}
+	}
+
+	if reffile != "" {
+		ref, err := readHashes(reffile)
+		if err != nil {
+			return err
+		}
+		if diff := compareHashes(hashes[0], ref); len(diff) > 0 {
+			return fmt.Errorf("files differ from %s: %s: %w", reffile, strings.Join(diff, ", "), errNotReproducible)
+		}
+	}
+
+	fmt.Println("Output is reproducible")
+
+	return skipped
+}
+
+func reproCommand(args []string) {
+
+	fs := flag.NewFlagSet("repro", flag.ExitOnError)
+	var sitenames siteFlag
+	fs.Var(&sitenames, "site", "site configuration file, may be repeated (default site.json)")
+	var calnames siteFlag
+	fs.Var(&calnames, "calibration", "reader calibration file written by the calibrate command, may be repeated for several sites")
+	day := fs.String("day", "", "day to process, YYYY-MM-DD (required unless -start and -end are given)")
+	start := fs.String("start", "", "first day to process, YYYY-MM-DD")
+	end := fs.String("end", "", "last day to process, YYYY-MM-DD")
+	savefile := fs.String("save", "", "file to write the hashes of the output files to")
+	reffile := fs.String("compare", "", "file with the hashes from an earlier run to compare with")
+	keep := fs.Bool("keep", false, "keep the output directories of both runs")
+	th := thresholdFlags(fs)
+	lopts := locationFlags(fs)
+	opts := smoothFlags(fs)
+	fs.Parse(args)
+
+	if *day != "" {
+		*start, *end = *day, *day
+	}
+	if *start == "" || *end == "" {
+		fmt.Fprintf(os.Stderr, "rfid: repro requires -day, or -start and -end\n")
+		os.Exit(exitUsage)
+	}
+
+	t0, err := parseDate(*start)
+	check(err)
+	t1, err := parseDate(*end)
+	check(err)
+
+	check(setupSites(sitenames))
+	check(setupCalibrations(calnames))
+	check(opts.check())
+	check(lopts.Check())
+
+	check(runRepro(t0, t1, *savefile, *reffile, *keep, th, lopts, opts))
+}
@@ -0,0 +1,88 @@
+/*
+The run-all command runs every step of the pipeline in sequence, using
+a single directory for all intermediate and final files.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kshedden/rfid/rfid"
+)
+
+func runAllCommand(args []string) {
+
+	fs := flag.NewFlagSet("run-all", flag.ExitOnError)
+	var sitenames siteFlag
+	fs.Var(&sitenames, "site", "site configuration file, may be repeated (default site.json)")
+	var calnames siteFlag
+	fs.Var(&calnames, "calibration", "reader calibration file written by the calibrate command, may be repeated for several sites")
+	dir := fs.String("dir", ".", "directory for all intermediate and final files")
+	start := fs.String("start", "", "first day to process, YYYY-MM-DD (default first file present)")
+	end := fs.String("end", "", "last day to process, YYYY-MM-DD (default last file present)")
+	th := thresholdFlags(fs)
+	lopts := locationFlags(fs)
+	opts := smoothFlags(fs)
+	fs.Parse(args)
+
+	t0, err := parseDate(*start)
+	check(err)
+	t1, err := parseDate(*end)
+	check(err)
+
+	check(setupSites(sitenames))
+	check(setupCalibrations(calnames))
+	check(opts.check())
+	check(lopts.Check())
+
+	check(runPipeline(*dir, t0, t1, th, lopts, opts))
+}
+
+// runPipeline runs every step of the pipeline for the days from start to end, using
+// dir for all intermediate and final files.  Steps that skip some of their input
+// don't stop the pipeline, but the returned error then wraps errSkipped.
+func runPipeline(dir string, start, end time.Time, th *rfid.QualityThresholds, lopts *rfid.LocationOptions, opts *smoothOptions) error {
+
+	var nskip int
+	var err error
+	step := func(serr error) {
+		if err != nil {
+			return
+		}
+		if errors.Is(serr, errSkipped) {
+			fmt.Fprintf(os.Stderr, "rfid: %v\n", serr)
+			nskip++
+			return
+		}
+		err = serr
+	}
+
+	step(runClarity(dir))
+	step(runIngest(dir, dir, start, end, th, lopts, opts.workers))
+	if opts.joint > 0 {
+		step(runJoint(dir, dir, opts))
+	} else {
+		for _, pt := range []personType{patient, provider} {
+			step(runSmooth(dir, dir, pt, opts))
+		}
+	}
+	step(runMatch(dir, dir))
+	for _, pt := range []personType{patient, provider} {
+		step(runExport(dir, dir, pt, nil))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if nskip > 0 {
+		return fmt.Errorf("run-all: %d steps finished with problems: %w", nskip, errSkipped)
+	}
+
+	return nil
+}
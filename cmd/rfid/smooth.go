@@ -0,0 +1,1267 @@
+/*
+The smooth command takes the raw unsmoothed location data and uses an HMM to smooth it.
+The locations for each site and day are smoothed in turn, so only one day of locations
+is held in memory.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"gonum.org/v1/gonum/floats"
+
+	"github.com/kshedden/rfid/rfid"
+	"github.com/kshedden/rfid/store"
+)
+
+type personType int
+
+const (
+	provider personType = iota
+	patient
+)
+
+// modelKey identifies the model parameters for one role at one site.
+type modelKey struct {
+	site string
+	role string
+}
+
+// smoother holds the options and the models for smoothing the locations of one
+// person type.  It is not changed once it is set up, so sequences can be smoothed
+// concurrently.
+type smoother struct {
+
+	// The options for the run
+	opts *smoothOptions
+
+	// Extract the field that identifies a distinct person.
+	personID personSelector
+
+	// The roles for the person type, in order of priority, ending with the default
+	// role that matches everyone
+	roles []*rfid.Role
+
+	// The transition probabilities for each site and role
+	trans map[modelKey][][]float64
+
+	// The emission probabilities for each site and role
+	emis map[modelKey][][]float64
+
+	// The starting probabilities for each site and role
+	start map[modelKey][]float64
+
+	// The dwell time probabilities for each site and role, used by the HSMM
+	dur map[modelKey][][]float64
+
+	// The models for the signals heard from every room for each site and role, used
+	// by the signal emission model, nil where they can't be fit
+	signal map[modelKey]*rfid.SignalModel
+}
+
+// smoothOptions holds the options that control the smoothing.
+type smoothOptions struct {
+
+	// If positive, estimate the HMM parameters from the data using at most
+	// this many EM iterations
+	trainIter int
+
+	// The emission model, "signal" to model the signals heard from every room in
+	// each minute, or "room" to use only the room with the strongest signal
+	emission string
+
+	// The model, "hmm" or "hsmm"
+	model string
+
+	// The number of rounds of joint patient and provider decoding, 0 to smooth
+	// each person type on its own
+	joint int
+
+	// When decoding jointly, the likelihood of a room is multiplied by up to 1 plus
+	// this value when a person of the other type is there
+	jointWeight float64
+
+	// The file defining the models for each role, empty to use the standard
+	// models for patients and providers
+	roles string
+
+	// The number of sequences smoothed concurrently, also used for the number of
+	// days ingested concurrently by run-all
+	workers int
+
+	// Don't report the progress of smoothing and training
+	quiet bool
+}
+
+// smoothFlags defines the flags for the smoothing options.
+func smoothFlags(fs *flag.FlagSet) *smoothOptions {
+
+	opts := new(smoothOptions)
+	fs.IntVar(&opts.trainIter, "train-iter", 0, "estimate the HMM parameters from the data using up to this many EM iterations, each reading the locations once")
+	fs.StringVar(&opts.emission, "emission", "signal", "emission model: signal (model of the signals from every room) or room (strongest room only)")
+	fs.StringVar(&opts.model, "model", "hmm", "smoothing model: hmm, or hsmm for explicit room dwell times")
+	fs.IntVar(&opts.joint, "joint", 0, "rounds of joint patient and provider decoding using co-location (0 to smooth separately)")
+	fs.Float64Var(&opts.jointWeight, "joint-weight", 2, "strength of the co-location evidence in joint decoding")
+	fs.IntVar(&opts.workers, "workers", runtime.NumCPU(), "number of concurrent workers for smoothing sequences (and ingesting days in run-all)")
+	fs.StringVar(&opts.roles, "roles", "", "JSON file with the start, transition and emission models for each role, e.g. roles.json")
+	fs.BoolVar(&opts.quiet, "quiet", false, "don't report the progress of smoothing and training")
+
+	return opts
+}
+
+// check returns an error if the options are invalid.
+func (opts *smoothOptions) check() error {
+
+	switch opts.emission {
+	case "signal", "room":
+	default:
+		return fmt.Errorf("unknown emission model '%s'", opts.emission)
+	}
+
+	switch opts.model {
+	case "hmm", "hsmm":
+	default:
+		return fmt.Errorf("unknown model '%s'", opts.model)
+	}
+
+	if opts.joint < 0 || opts.jointWeight < 0 {
+		return fmt.Errorf("joint decoding rounds and weight must not be negative")
+	}
+
+	if opts.workers < 1 {
+		return fmt.Errorf("the number of workers must be positive")
+	}
+
+	return nil
+}
+
+// model is the interface used to set up an HMM or HSMM.
+type model interface {
+	SetStart([]float64)
+	SetTransmission([][]float64)
+	SetEmission([][]float64)
+	SetData([]int)
+	SetLikelihood([][]float64)
+	Fit() error
+}
+
+type personSelector func(*rfid.Location) uint64
+
+func normalize(mat [][]float64) {
+
+	p := len(mat)
+	q := len(mat[0])
+
+	for j := 0; j < p; j++ {
+		f := 0.0
+		for k := 0; k < q; k++ {
+			f += mat[j][k]
+		}
+		for k := 0; k < q; k++ {
+			mat[j][k] /= f
+		}
+	}
+}
+
+// makeTrans constructs the probability transition matrix for the HMM for a role, for
+// locations in time windows of the given length.
+func makeTrans(site *rfid.SiteConfig, role *rfid.Role, window time.Duration) ([][]float64, error) {
+
+	var stick float64
+	switch role.PersonType() {
+	case rfid.Patient:
+		stick = weight(role.Stay, 50)
+	case rfid.Provider:
+		stick = weight(role.Stay, 10)
+	default:
+		return nil, fmt.Errorf("role %s: unknown person type %d", role.Name, role.PersonType())
+	}
+	trans := makeTransPerson(site, role.PersonType(), window, stick)
+
+	// Role-specific weights for moving into each room
+	var changed bool
+	for k := range trans {
+		w := role.MoveWeight(site.Room(rfid.RoomCode(k)))
+		if w == 1 {
+			continue
+		}
+		changed = true
+		for j := range trans {
+			if j != k {
+				trans[j][k] *= w
+			}
+		}
+	}
+	if changed {
+		normalize(trans)
+	}
+
+	if window != time.Minute {
+		scaleTrans(trans, window.Minutes())
+	}
+
+	return trans, nil
+}
+
+// scaleTrans adjusts transition probabilities for one minute to apply to w minutes,
+// so that the probability of staying in each room for w minutes is unchanged.
+func scaleTrans(trans [][]float64, w float64) {
+
+	for j := range trans {
+		stay := trans[j][j]
+		if stay == 1 {
+			continue
+		}
+		f := (1 - math.Pow(stay, w)) / (1 - stay)
+		for k := range trans[j] {
+			trans[j][k] *= f
+		}
+		trans[j][j] = math.Pow(stay, w)
+	}
+}
+
+// weight returns w, or def if w is zero.
+func weight(w, def float64) float64 {
+
+	if w == 0 {
+		return def
+	}
+
+	return w
+}
+
+// makeTransPerson constructs the probability transition matrix for a type of person,
+// where stick is the weight of staying in the same room.  The weights of the moves
+// between rooms come from the floor plan of the site.
+func makeTransPerson(site *rfid.SiteConfig, pt rfid.PersonType, window time.Duration, stick float64) [][]float64 {
+
+	p := site.NumRooms()
+	trans := alloc(p, p)
+
+	for j := 0; j < p; j++ {
+		for k := 0; k < p; k++ {
+			if j == k {
+				trans[j][k] = stick
+			} else {
+				trans[j][k] = site.MoveWeight(pt, rfid.RoomCode(j), rfid.RoomCode(k), window)
+			}
+		}
+	}
+
+	normalize(trans)
+
+	return trans
+}
+
+// alloc constructs a m x n rectangular array of float64 arrays.
+func alloc(m, n int) [][]float64 {
+
+	mat := make([][]float64, m)
+	for j := 0; j < m; j++ {
+		mat[j] = make([]float64, n)
+	}
+
+	return mat
+}
+
+// makeEmission returns the emission probability matrix for a role.
+func makeEmission(site *rfid.SiteConfig, role *rfid.Role) ([][]float64, error) {
+
+	same := weight(role.Same, 10)
+	switch role.PersonType() {
+	case rfid.Patient:
+		return makeEmissionPatient(site, same), nil
+	case rfid.Provider:
+		return makeEmissionProvider(site, same), nil
+	default:
+		return nil, fmt.Errorf("role %s: unknown person type %d", role.Name, role.PersonType())
+	}
+}
+
+// makeExchEmis makes two states in an emission matrix exchangeable.
+func makeExchEmis(emis [][]float64, i1, i2 rfid.RoomCode, r float64) [][]float64 {
+
+	emis[i1][i1] = r
+	emis[i1][i2] = r
+	emis[i2][i1] = r
+	emis[i2][i2] = r
+
+	return emis
+}
+
+// makeEmissionPatient constucts the emission probability matrix for the HMM for a patient.
+// The ratio of the probability that the observed room is the actual room to the probability
+// that the obvserved room is not the actual room is same.
+func makeEmissionPatient(site *rfid.SiteConfig, same float64) [][]float64 {
+
+	p := site.NumRooms()
+	emis := alloc(p, p)
+
+	for j := 0; j < p; j++ {
+		for k := 0; k < p; k++ {
+
+			switch {
+			case j == k:
+				emis[j][k] = same
+			default:
+				emis[j][k] = 1
+			}
+		}
+	}
+
+	// Checkout and CheckoutFinal are exchangeable
+	for _, room := range site.Rooms {
+		if room.Category == rfid.CheckoutRoom {
+			emis = makeExchEmis(emis, room.Code, rfid.CheckoutFinal, same/2)
+		}
+	}
+
+	// Checkin and NoSignal are exchangeable
+	emis = makeExchEmis(emis, rfid.Checkin, rfid.NoSignal, same/2)
+
+	normalize(emis)
+
+	return emis
+}
+
+// makeEmissionProvider constucts the emission probability matrix for the HMM for a provider,
+// with the same ratio as for patients.
+func makeEmissionProvider(site *rfid.SiteConfig, same float64) [][]float64 {
+
+	p := site.NumRooms()
+	emis := alloc(p, p)
+
+	for j := 0; j < p; j++ {
+		for k := 0; k < p; k++ {
+			if j == k {
+				emis[j][k] = same
+			} else {
+				emis[j][k] = 1
+			}
+		}
+	}
+
+	normalize(emis)
+
+	return emis
+}
+
+// locsort sorts location records by site, person id, tag id, and timestamp.
+type locsort struct {
+	locs     []*rfid.Location
+	personID personSelector
+}
+
+func (s locsort) Len() int      { return len(s.locs) }
+func (s locsort) Swap(i, j int) { s.locs[i], s.locs[j] = s.locs[j], s.locs[i] }
+func (s locsort) Less(i, j int) bool {
+
+	a, personID := s.locs, s.personID
+
+	if a[i].Site != a[j].Site {
+		return a[i].Site < a[j].Site
+	}
+
+	if personID(a[i]) < personID(a[j]) {
+		return true
+	}
+
+	if personID(a[i]) > personID(a[j]) {
+		return false
+	}
+	// below here the ID's are equal
+
+	if a[i].TagId < a[j].TagId {
+		return true
+	}
+
+	if a[i].TagId > a[j].TagId {
+		return false
+	}
+	// below here the tag id's are equal
+
+	return a[i].TimeStamp.Before(a[j].TimeStamp)
+}
+
+// continuize fills in the gaps where no signal was detected for a tag
+func continuize(locs []*rfid.Location) []*rfid.Location {
+
+	var locx []*rfid.Location
+	locx = append(locx, locs[0])
+	step := locs[0].WindowLength()
+
+	for i := 1; i < len(locs); i++ {
+
+		lastloc := locx[len(locx)-1]
+
+		for locs[i].TimeStamp.Sub(lastloc.TimeStamp) > step {
+			x := new(rfid.Location)
+			*x = *lastloc
+			x.TimeStamp = x.TimeStamp.Add(step)
+			x.IP = rfid.NoSignal
+			x.Signal = 0
+			x.IP2 = rfid.Null
+			x.Signal2 = 0
+			x.Signals = nil
+			lastloc = x
+			locx = append(locx, x)
+		}
+
+		locx = append(locx, locs[i])
+	}
+
+	return locx
+}
+
+// The longest dwell time in one room, in minutes, allowed by the HSMM
+const maxDwell = 240
+
+// makeDuration constructs the dwell time distributions for the HSMM for a role, using
+// typical dwell times in minutes for each category of room unless the role gives them.
+// The dwell times are given as numbers of time windows of the given length.
+func makeDuration(site *rfid.SiteConfig, role *rfid.Role, window time.Duration) ([][]float64, error) {
+
+	person := role.PersonType()
+
+	p := site.NumRooms()
+	dur := make([][]float64, p)
+
+	w := window.Minutes()
+	nmax := int(math.Max(maxDwell/w, 1))
+
+	for j := 0; j < p; j++ {
+
+		room := site.Room(rfid.RoomCode(j))
+
+		// Patients stay in CheckoutFinal (absorbing state) until the data end
+		if person == rfid.Patient && rfid.RoomCode(j) == rfid.CheckoutFinal {
+			flat := make([]float64, nmax)
+			for k := range flat {
+				flat[k] = 1
+			}
+			dur[j] = rfid.EmpiricalDuration(flat)
+			continue
+		}
+
+		mean, ok := role.DwellMean(room)
+		switch {
+		case ok:
+		case person == rfid.Provider && room.Category == rfid.ExamRoom:
+			mean = 5
+		case person == rfid.Provider && room.Category == rfid.AdminRoom:
+			mean = 20
+		case person == rfid.Provider:
+			mean = 5
+		case room.Category == rfid.ExamRoom:
+			mean = 15
+		case room.Category == rfid.FieldRoom:
+			// Visual field tests
+			mean = 10
+		case room.Category == rfid.OtherRoom:
+			// Waiting areas, e.g. for dilation
+			mean = 30
+		case room.Category == rfid.ImagingRoom, room.Category == rfid.CheckoutRoom:
+			mean = 5
+		default:
+			mean = 10
+		}
+
+		var err error
+		if dur[j], err = rfid.NegBinomDuration(math.Max(mean/w, 1), 2, nmax); err != nil {
+			return nil, fmt.Errorf("role %s, room %s: %w", role.Name, room.Name, err)
+		}
+	}
+
+	return dur, nil
+}
+
+// makeStart generates the starting probability distribution for the HMM for a role.
+func makeStart(site *rfid.SiteConfig, role *rfid.Role) ([]float64, error) {
+
+	start := make([]float64, site.NumRooms())
+	for i := range start {
+		start[i] = 1
+	}
+
+	pt := role.PersonType()
+	if pt == rfid.Patient {
+		// Prefer to start patients at checkin
+		start[rfid.Checkin] = 10
+	}
+
+	for _, room := range site.Rooms {
+		if !room.Allows(pt) {
+			// Rooms where this type of person cannot go.
+			start[room.Code] = 0
+		} else {
+			start[room.Code] *= role.StartWeight(room)
+		}
+	}
+
+	// Normalize
+	tot := floats.Sum(start)
+	if tot == 0 {
+		return nil, fmt.Errorf("site %s, role %s: no room has a positive starting probability", site.Name, role.Name)
+	}
+	floats.Scale(1/tot, start)
+
+	return start, nil
+}
+
+// process uses the HMM to smooth locations for one person/tag/day, and returns the
+// smoothed locations with their posterior location probabilities.  If the HMM can't be
+// fit, the unsmoothed locations are used and an error is returned.  Only the locations
+// of the sequence are changed, so sequences can be processed concurrently.  When
+// decoding jointly, copresence gives the probability that a person of the other type
+// is in each room at each minute, otherwise it is nil.
+func (sm *smoother) process(locs []*rfid.Location, copresence *rfid.Presence) ([]*rfid.Location, [][]float64, error) {
+
+	locs = continuize(locs)
+
+	site, ok := sites[locs[0].Site]
+	if !ok {
+		return nil, nil, fmt.Errorf("no configuration for site '%s'", locs[0].Site)
+	}
+	role, err := sm.roleOf(locs[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key := modelKey{site.Name, role.Name}
+
+	loci := make([]int, len(locs))
+	for i, r := range locs {
+		loci[i] = int(r.IP)
+	}
+
+	setup := func(m model) {
+		m.SetTransmission(sm.trans[key])
+		m.SetEmission(sm.emis[key])
+		m.SetStart(sm.start[key])
+		m.SetData(loci)
+		if lik := sm.likelihood(locs, site, sm.emis[key], sm.signal[key], copresence); lik != nil {
+			m.SetLikelihood(lik)
+		}
+	}
+
+	var pred []int
+	var post [][]float64
+	switch sm.opts.model {
+	case "hsmm":
+		hsmm := new(rfid.HSMM)
+		setup(hsmm)
+		hsmm.SetDuration(sm.dur[key])
+		err = hsmm.Fit()
+		pred, post = hsmm.Pred, hsmm.PostProb
+	default:
+		hmm := new(rfid.HMM)
+		setup(hmm)
+		// Most transitions are impossible, e.g. patients moving between exam rooms
+		hmm.SetSparseTransmission(rfid.NewSparseTrans(sm.trans[key]))
+		err = hmm.Fit()
+		pred, post = hmm.Pred, hmm.PostProb
+	}
+
+	if err != nil {
+		for _, r := range locs {
+			r.IPhmm = r.IP
+			r.PostHMM = 0
+			r.IPhmm2 = rfid.Null
+			r.PostHMM2 = 0
+			r.EntropyHMM = 0
+		}
+		return locs, nil, fmt.Errorf("site %s, tag %d, CSN %d, UMid %d, %s: %w", site.Name, locs[0].TagId,
+			locs[0].CSN, locs[0].UMid, locs[0].TimeStamp.Format("2006-01-02"), err)
+	}
+
+	for i, r := range locs {
+		r.SetPosterior(rfid.RoomCode(pred[i]), post[i])
+	}
+
+	return locs, post, nil
+}
+
+// likelihood returns the likelihood of the data in each minute for each room, using
+// the signal model m if it is not nil and otherwise the emission probabilities e, or
+// nil if the model should use the room with the strongest signal directly.  When decoding jointly, the likelihood of the rooms where
+// the other person type is likely to be, given by copresence, is increased.
+func (sm *smoother) likelihood(locs []*rfid.Location, site *rfid.SiteConfig, e [][]float64, m *rfid.SignalModel,
+	copresence *rfid.Presence) [][]float64 {
+
+	var lik [][]float64
+	switch {
+	case m != nil:
+		lik = m.Likelihood(locs, e)
+	case copresence != nil:
+		lik = alloc(len(locs), len(e))
+		for i, r := range locs {
+			for j := range e {
+				lik[i][j] = e[j][r.IP]
+			}
+		}
+	default:
+		return nil
+	}
+
+	if copresence != nil {
+		copresence.Boost(lik, locs, sm.opts.jointWeight, site)
+	}
+
+	return lik
+}
+
+// sequences splits sorted locations into the sequences for each person/tag/day, with
+// the people identified by personID.
+func sequences(locs []*rfid.Location, personID personSelector) [][]*rfid.Location {
+
+	var seqs [][]*rfid.Location
+
+	i := 0
+	for i < len(locs) {
+
+		j := i + 1
+		for j < len(locs) {
+
+			if locs[i].Site != locs[j].Site {
+				break
+			}
+
+			if locs[i].TagId != locs[j].TagId || personID(locs[i]) != personID(locs[j]) {
+				break
+			}
+
+			if !locs[i].TimeStamp.Truncate(24 * time.Hour).Equal(locs[j].TimeStamp.Truncate(24 * time.Hour)) {
+				break
+			}
+
+			j++
+		}
+
+		seqs = append(seqs, locs[i:j])
+		i = j
+	}
+
+	return seqs
+}
+
+// run smooths the person/tag/day sequences using a pool of sm.opts.workers goroutines.
+// The smoothed locations are in the same order as the sequences, whatever the number of
+// workers.  Sequences where the HMM can't be fit keep their unsmoothed locations, and
+// are reported and counted.  When decoding jointly, copresence is used as in process,
+// and the posterior probabilities are added to collect, otherwise both are nil.
+func (sm *smoother) run(locs []*rfid.Location, copresence, collect *rfid.Presence) ([]*rfid.Location, int, error) {
+
+	seqs := sequences(locs, sm.personID)
+
+	type result struct {
+		locs []*rfid.Location
+		post [][]float64
+		err  error
+	}
+	results := make([]result, len(seqs))
+
+	jobs := make(chan int)
+	done := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < sm.opts.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := &results[i]
+				r.locs, r.post, r.err = sm.process(seqs[i], copresence)
+				done <- i
+			}
+		}()
+	}
+
+	go func() {
+		for i := range seqs {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(done)
+	}()
+
+	prog := newProgress(len(seqs), progressLog(sm.opts.quiet))
+	for range done {
+		prog.step()
+	}
+
+	// Collect the results in order, so that the output does not depend on the
+	// order in which the workers finish.
+	var rlocs []*rfid.Location
+	var nfail int
+	for _, r := range results {
+		if errors.Is(r.err, rfid.ErrDegenerateHMM) {
+			fmt.Fprintf(os.Stderr, "Using unsmoothed locations: %v\n", r.err)
+			nfail++
+		} else if r.err != nil {
+			return nil, nfail, r.err
+		}
+
+		if collect != nil && r.post != nil {
+			for i, loc := range r.locs {
+				collect.Add(loc.Site, loc.TimeStamp, r.post[i])
+			}
+		}
+
+		rlocs = append(rlocs, r.locs...)
+	}
+
+	return rlocs, nfail, nil
+}
+
+// progressLog returns the logger for progress reports, which go to standard error,
+// or nil if quiet is set.
+func progressLog(quiet bool) *log.Logger {
+
+	if quiet {
+		return nil
+	}
+
+	return log.New(os.Stderr, "", 0)
+}
+
+// progress reports the number of sequences smoothed so far to a logger, each time
+// another tenth of them is done.
+type progress struct {
+	log  *log.Logger
+	n    int
+	done int
+	next int
+}
+
+// newProgress returns a progress reporter for n sequences, which reports nothing if
+// lg is nil.
+func newProgress(n int, lg *log.Logger) *progress {
+	return &progress{log: lg, n: n, next: 1}
+}
+
+// step records that one more sequence has been smoothed.
+func (p *progress) step() {
+
+	p.done++
+	if p.log != nil && p.done*10 >= p.next*p.n {
+		p.log.Printf("Smoothed %d of %d sequences", p.done, p.n)
+		for p.done*10 >= p.next*p.n {
+			p.next++
+		}
+	}
+}
+
+// train estimates the start, transition and emission probabilities for each site
+// and role from the person/tag/day sequences, using the hand-specified probabilities as
+// starting values.  Transitions and emissions that are impossible under the
+// starting values remain impossible.  Sequences that have zero probability under
+// the starting values can't be used, and are left out.  The estimates are based on
+// the room with the strongest signal in each minute.  Each EM iteration reads the
+// store one partition at a time, so only one partition is held in memory, at the
+// cost of reading the store once per iteration.
+func (sm *smoother) train(in *store.Store, iters int) error {
+
+	lg := progressLog(sm.opts.quiet)
+
+	// The sites and roles in a fixed order, so that the progress is reported the
+	// same way every time
+	var keys []modelKey
+	trainers := make(map[modelKey]*rfid.Trainer)
+	for _, site := range siteList {
+		for _, role := range sm.roles {
+
+			key := modelKey{site.Name, role.Name}
+			hmm := new(rfid.HMM)
+			hmm.SetTransmission(sm.trans[key])
+			hmm.SetEmission(sm.emis[key])
+			hmm.SetStart(sm.start[key])
+
+			opts := rfid.TrainOptions{MaxIter: iters, Tol: 1e-4, Prior: 0.1}
+			if lg != nil {
+				name, rname := site.Name, role.Name
+				opts.Report = func(iter int, loglik float64) {
+					lg.Printf("Training %s %s model: iteration %d, log-likelihood %.2f",
+						name, rname, iter, loglik)
+				}
+			}
+
+			keys = append(keys, key)
+			trainers[key] = rfid.NewTrainer(hmm, opts)
+		}
+	}
+
+	for {
+		var active bool
+		for _, key := range keys {
+			active = active || !trainers[key].Done()
+		}
+		if !active {
+			break
+		}
+
+		for _, p := range in.Partitions() {
+
+			locs, err := sm.readPart(in, p)
+			if err != nil {
+				return err
+			}
+
+			if err := sm.trainData(locs, trainers); err != nil {
+				return err
+			}
+		}
+
+		for _, key := range keys {
+			trainers[key].Step()
+		}
+	}
+
+	for _, key := range keys {
+		hmm := trainers[key].HMM()
+		sm.trans[key] = hmm.Transmission()
+		sm.emis[key] = hmm.Emission()
+		sm.start[key] = hmm.Start()
+	}
+
+	return nil
+}
+
+// trainData adds the sequences of room codes for the person/tag/day sequences in locs
+// to the trainers for their sites and roles, leaving out the sequences that have zero
+// probability.
+func (sm *smoother) trainData(locs []*rfid.Location, trainers map[modelKey]*rfid.Trainer) error {
+
+	for _, seq := range sequences(locs, sm.personID) {
+
+		name := seq[0].Site
+		if _, ok := sites[name]; !ok {
+			return fmt.Errorf("no configuration for site '%s'", name)
+		}
+		role, err := sm.roleOf(seq[0])
+		if err != nil {
+			return err
+		}
+		tr := trainers[modelKey{name, role.Name}]
+		if tr.Done() {
+			continue
+		}
+
+		seq = continuize(seq)
+		loci := make([]int, len(seq))
+		for i, r := range seq {
+			loci[i] = int(r.IP)
+		}
+
+		if err := tr.Add(loci); err != nil && !errors.Is(err, rfid.ErrDegenerateHMM) {
+			return fmt.Errorf("training %s %s model: %w", name, role.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Use UMid to identify providers
+func providerID(r *rfid.Location) uint64 {
+	return r.UMid
+}
+
+// Use CSN to identify patients
+func patientID(r *rfid.Location) uint64 {
+	return r.CSN
+}
+
+// personName returns the label used for a person type in file names.
+func personName(person personType) string {
+
+	switch person {
+	case patient:
+		return "patient"
+	case provider:
+		return "provider"
+	default:
+		return fmt.Sprintf("person%d", int(person))
+	}
+}
+
+// runSmooth smooths the locations for one person type, reading the unsmoothed
+// locations from indir and writing the smoothed locations to outdir, one partition at
+// a time.  If requested in opts, the HMM parameters are first estimated from the data.
+// If the smoothed locations can't all be written, the partial store is removed.
+func runSmooth(indir, outdir string, person personType, opts *smoothOptions) error {
+
+	if err := opts.check(); err != nil {
+		return err
+	}
+
+	in, err := store.Open(locDir(indir, person, ""))
+	if err != nil {
+		return err
+	}
+
+	sm, err := newSmoother(in, person, opts)
+	if err != nil {
+		return err
+	}
+
+	var outs outputStores
+	defer outs.abort()
+	out, err := outs.create(locDir(outdir, person, "_s"))
+	if err != nil {
+		return err
+	}
+
+	var nfail int
+	for _, p := range in.Partitions() {
+
+		locs, err := sm.readPart(in, p)
+		if err != nil {
+			return err
+		}
+
+		rlocs, nf, err := sm.run(locs, nil, nil)
+		if err != nil {
+			return err
+		}
+		nfail += nf
+
+		if err := out.Write(p.Site, p.Day, rlocs); err != nil {
+			return err
+		}
+	}
+
+	if err := outs.close(); err != nil {
+		return err
+	}
+
+	return smoothFailures(person, nfail)
+}
+
+// selectPerson returns the person identifier for a person type.
+func selectPerson(person personType) personSelector {
+
+	if person == provider {
+		return providerID
+	}
+
+	return patientID
+}
+
+// readPart reads the unsmoothed locations in one partition of a store, sorted by
+// person, tag and time.
+func (sm *smoother) readPart(in *store.Store, p store.Partition) ([]*rfid.Location, error) {
+
+	locs, err := in.Read(p)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(locsort{locs, sm.personID})
+
+	return locs, nil
+}
+
+// newSmoother constructs the model parameters at each site for each role of one person
+// type.  If requested in opts, the HMM parameters are estimated from the locations in
+// the store.
+func newSmoother(in *store.Store, person personType, opts *smoothOptions) (*smoother, error) {
+
+	roles, err := personRoles(person, opts.roles)
+	if err != nil {
+		return nil, err
+	}
+
+	sm := &smoother{
+		opts:     opts,
+		personID: selectPerson(person),
+		roles:    roles,
+		trans:    make(map[modelKey][][]float64),
+		emis:     make(map[modelKey][][]float64),
+		start:    make(map[modelKey][]float64),
+		dur:      make(map[modelKey][][]float64),
+		signal:   make(map[modelKey]*rfid.SignalModel),
+	}
+
+	// All locations have the same time window
+	window := time.Minute
+	if parts := in.Partitions(); len(parts) > 0 {
+		r, err := in.OpenPartition(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		loc, err := r.Next()
+		r.Close()
+		if err == nil {
+			window = loc.WindowLength()
+		} else if err != io.EOF {
+			return nil, err
+		}
+	}
+
+	for name, site := range sites {
+		for _, role := range roles {
+			key := modelKey{name, role.Name}
+			if sm.trans[key], err = makeTrans(site, role, window); err != nil {
+				return nil, err
+			}
+			if sm.emis[key], err = makeEmission(site, role); err != nil {
+				return nil, err
+			}
+			if sm.start[key], err = makeStart(site, role); err != nil {
+				return nil, err
+			}
+			if sm.dur[key], err = makeDuration(site, role, window); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.emission == "signal" {
+		if err := sm.fitSignal(in); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.trainIter > 0 {
+		if err := sm.train(in, opts.trainIter); err != nil {
+			return nil, err
+		}
+	}
+
+	return sm, nil
+}
+
+// fitSignal fits the signal model for each site and role, reading the store one
+// partition at a time.  The room with the strongest signal in each minute is taken as
+// the person's room.
+func (sm *smoother) fitSignal(in *store.Store) error {
+
+	stats := make(map[modelKey]*rfid.SignalStats)
+	for _, p := range in.Partitions() {
+
+		locs, err := in.Read(p)
+		if err != nil {
+			return err
+		}
+
+		for _, loc := range locs {
+			site, ok := sites[loc.Site]
+			if !ok {
+				return fmt.Errorf("no configuration for site '%s'", loc.Site)
+			}
+			role, err := sm.roleOf(loc)
+			if err != nil {
+				return err
+			}
+			key := modelKey{site.Name, role.Name}
+			if stats[key] == nil {
+				stats[key] = rfid.NewSignalStats(site.NumRooms())
+			}
+			stats[key].Add(loc)
+		}
+	}
+
+	for key, st := range stats {
+		sm.signal[key] = st.Model()
+	}
+
+	return nil
+}
+
+// smoothFailures returns an error wrapping errSkipped if some sequences for a person
+// type could not be smoothed.
+func smoothFailures(person personType, nfail int) error {
+
+	if nfail > 0 {
+		return fmt.Errorf("smooth: %d %s sequences not smoothed: %w", nfail, personName(person), errSkipped)
+	}
+
+	return nil
+}
+
+// personRoles returns the roles for one person type, from the role configuration in
+// fname if it is not empty, followed by the default role for the person type.
+func personRoles(person personType, fname string) ([]*rfid.Role, error) {
+
+	pt := rfid.Patient
+	if person == provider {
+		pt = rfid.Provider
+	}
+	def := rfid.DefaultRole(pt)
+
+	if fname == "" {
+		return []*rfid.Role{def}, nil
+	}
+
+	cfg, err := rfid.LoadRoleConfig(fname)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckSites(siteList); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	var rs []*rfid.Role
+	for _, role := range cfg.Roles {
+		if role.Name == rfid.DefaultRole(rfid.Patient).Name || role.Name == rfid.DefaultRole(rfid.Provider).Name {
+			return nil, fmt.Errorf("%s: role name '%s' is used for the standard model", fname, role.Name)
+		}
+		if role.PersonType() == pt {
+			rs = append(rs, role)
+		}
+	}
+
+	return append(rs, def), nil
+}
+
+// roleOf returns the role used to smooth the locations of a person.  An error is
+// returned if no role matches, which happens if the locations of patients and
+// providers are mixed up.
+func (sm *smoother) roleOf(loc *rfid.Location) (*rfid.Role, error) {
+
+	for _, role := range sm.roles {
+		if role.Matches(loc.PersonCat, loc.ProviderCat) {
+			return role, nil
+		}
+	}
+
+	return nil, fmt.Errorf("site %s, tag %d: no role for person type %d", loc.Site, loc.TagId, loc.PersonCat)
+}
+
+// runJoint smooths the patient and provider locations jointly, reading the unsmoothed
+// locations from indir and writing the smoothed locations to outdir, one partition at
+// a time.  For each partition the providers are first smoothed on their own.  Then for
+// opts.joint rounds, the patients and the providers are smoothed in turn, with the
+// likelihood of each room increased in the minutes where the other person type was
+// likely to be there in the previous pass.  If the smoothed locations can't all be
+// written, the partial stores are removed.
+func runJoint(indir, outdir string, opts *smoothOptions) error {
+
+	if err := opts.check(); err != nil {
+		return err
+	}
+
+	type jointPerson struct {
+		in       *store.Store
+		out      *store.Writer
+		sm       *smoother
+		locs     []*rfid.Location
+		rlocs    []*rfid.Location
+		partFail int
+		nfail    int
+	}
+
+	var outs outputStores
+	defer outs.abort()
+	people := make(map[personType]*jointPerson)
+	for _, pt := range []personType{patient, provider} {
+
+		in, err := store.Open(locDir(indir, pt, ""))
+		if err != nil {
+			return err
+		}
+		sm, err := newSmoother(in, pt, opts)
+		if err != nil {
+			return err
+		}
+		out, err := outs.create(locDir(outdir, pt, "_s"))
+		if err != nil {
+			return err
+		}
+		people[pt] = &jointPerson{in: in, out: out, sm: sm}
+	}
+
+	order := []personType{provider}
+	for i := 0; i < opts.joint; i++ {
+		order = append(order, patient, provider)
+	}
+
+	// The partitions with data for either person type
+	for _, p := range unionPartitions(people[patient].in, people[provider].in) {
+
+		for _, jp := range people {
+			var err error
+			if jp.locs, err = jp.sm.readPart(jp.in, p); err != nil {
+				return err
+			}
+		}
+
+		// The presence of the person type smoothed in the previous pass
+		var copresence *rfid.Presence
+		for _, pt := range order {
+			jp := people[pt]
+			collect := rfid.NewPresence()
+
+			var err error
+			jp.rlocs, jp.partFail, err = jp.sm.run(jp.locs, copresence, collect)
+			if err != nil {
+				return err
+			}
+
+			copresence = collect
+		}
+
+		for _, jp := range people {
+			jp.nfail += jp.partFail
+			if err := jp.out.Write(p.Site, p.Day, jp.rlocs); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := outs.close(); err != nil {
+		return err
+	}
+
+	var skipped error
+	for _, pt := range []personType{patient, provider} {
+		if err := smoothFailures(pt, people[pt].nfail); err != nil {
+			skipped = err
+		}
+	}
+
+	return skipped
+}
+
+func smoothCommand(args []string) {
+
+	fs := flag.NewFlagSet("smooth", flag.ExitOnError)
+	var sitenames siteFlag
+	fs.Var(&sitenames, "site", "site configuration file, may be repeated (default site.json)")
+	indir := fs.String("in", ".", "directory containing the unsmoothed locations")
+	outdir := fs.String("out", ".", "directory for the smoothed locations")
+	person := fs.String("person", "all", "person type to smooth: patient, provider or all")
+	opts := smoothFlags(fs)
+	fs.Parse(args)
+
+	pts, err := personTypes(*person)
+	check(err)
+	check(setupSites(sitenames))
+
+	if opts.joint > 0 {
+		if len(pts) != 2 {
+			check(fmt.Errorf("joint decoding requires -person all"))
+		}
+		check(runJoint(*indir, *outdir, opts))
+		return
+	}
+
+	var skipped error
+	for _, pt := range pts {
+		err := runSmooth(*indir, *outdir, pt, opts)
+		if errors.Is(err, errSkipped) {
+			skipped = err
+			continue
+		}
+		check(err)
+	}
+	check(skipped)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kshedden/rfid/rfid"
+	"github.com/kshedden/rfid/store"
+)
+
+// simulateLocations returns unsmoothed locations for npat patients over one day, each
+// visiting a few rooms at the default site.
+func simulateLocations(t testing.TB, npat int) []*rfid.Location {
+
+	if err := setupSites([]string{"../../site.json"}); err != nil {
+		t.Fatal(err)
+	}
+	site := siteList[0]
+
+	var rooms []rfid.RoomCode
+	for _, room := range site.Rooms {
+		if room.Category != rfid.VirtualRoom && room.Allows(rfid.Patient) {
+			rooms = append(rooms, room.Code)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(3))
+	t0 := time.Date(2018, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	var locs []*rfid.Location
+	for i := 0; i < npat; i++ {
+		tm := t0.Add(time.Duration(rng.Intn(120)) * time.Minute)
+		for v := 0; v < 4; v++ {
+			room := rooms[rng.Intn(len(rooms))]
+			for m := 0; m < 10+rng.Intn(20); m++ {
+				loc := &rfid.Location{Site: site.Name, TagId: uint64(i), CSN: uint64(1000 + i), TimeStamp: tm,
+					PersonCat: rfid.Patient, IP: room, IP2: rfid.Null}
+				loc.Signals = []rfid.RoomSignal{{Room: room, Signal: 1, Share: 1}}
+				if rng.Intn(5) == 0 {
+					// Some bleed from another room
+					other := rooms[rng.Intn(len(rooms))]
+					if other != room {
+						loc.IP2 = other
+						loc.Signals = append(loc.Signals, rfid.RoomSignal{Room: other, Signal: 0.5})
+					}
+				}
+				locs = append(locs, loc)
+				tm = tm.Add(time.Minute)
+			}
+		}
+	}
+
+	sort.Sort(locsort{locs, patientID})
+
+	return locs
+}
+
+// setupSmooth writes the locations to a store and returns a smoother for them that
+// uses the given number of workers.
+func setupSmooth(t testing.TB, locs []*rfid.Location, workers int) *smoother {
+
+	opts := &smoothOptions{emission: "signal", model: "hmm", workers: workers, quiet: true}
+	if err := opts.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	w, err := store.Create(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(locs[0].Site, locs[0].TimeStamp, locs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	in, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm, err := newSmoother(in, patient, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sm
+}
+
+// smoothWorkers smooths the locations with the given number of workers.
+func smoothWorkers(t testing.TB, locs []*rfid.Location, workers int) []*rfid.Location {
+
+	sm := setupSmooth(t, locs, workers)
+
+	rlocs, nfail, err := sm.run(locs, nil, nil)
+	if err != nil || nfail > 0 {
+		t.Fatalf("%d sequences failed: %v", nfail, err)
+	}
+
+	return rlocs
+}
+
+// The smoothed locations are the same, and in the same order, for any number of workers.
+func TestRunWorkers(t *testing.T) {
+
+	locs := simulateLocations(t, 50)
+
+	var results [][]rfid.Location
+	for _, workers := range []int{1, 4} {
+		var res []rfid.Location
+		for _, loc := range smoothWorkers(t, locs, workers) {
+			res = append(res, *loc)
+		}
+		results = append(results, res)
+	}
+
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Errorf("results differ between 1 and 4 workers")
+	}
+}
+
+// A run that fails part way through leaves no smoothed store behind.
+func TestRunSmoothAbort(t *testing.T) {
+
+	locs := simulateLocations(t, 5)
+
+	dir := t.TempDir()
+	w, err := store.Create(locDir(dir, patient, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1 := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	d2 := d1.AddDate(0, 0, 1)
+	for _, day := range []time.Time{d1, d2} {
+		if err := w.Write(locs[0].Site, day, locs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second partition can't be read
+	p := store.Partition{Site: locs[0].Site, Day: d2}
+	if err := os.WriteFile(path.Join(locDir(dir, patient, ""), p.String()), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &smoothOptions{emission: "signal", model: "hmm", workers: 1, quiet: true}
+	if err := runSmooth(dir, dir, patient, opts); err == nil {
+		t.Fatal("expected an error reading a corrupt partition")
+	}
+	if _, err := os.Stat(locDir(dir, patient, "_s")); !os.IsNotExist(err) {
+		t.Errorf("partial store was not removed: %v", err)
+	}
+}
+
+func BenchmarkRun(b *testing.B) {
+
+	locs := simulateLocations(b, 500)
+
+	workers := []int{1, 2, 4}
+	if n := runtime.NumCPU(); n > 4 {
+		workers = append(workers, n)
+	}
+
+	// Only the smoothing is timed, not writing the store or setting up the models
+	sm := setupSmooth(b, locs, 1)
+
+	for _, w := range workers {
+		b.Run(fmt.Sprintf("workers=%d", w), func(b *testing.B) {
+			sm.opts.workers = w
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := sm.run(locs, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
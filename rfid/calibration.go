@@ -0,0 +1,256 @@
+package rfid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// CalibrationVersion is the version of the calibration file format written by
+// this package.  Files with other versions are rejected.
+const CalibrationVersion = 1
+
+// Calibration holds per-reader corrections for differences in gain and placement.
+// The calibrated signal of a ping is Scale*signal + Offset, using the values for the
+// reader that received it.  Readers that are not listed are not changed.
+type Calibration struct {
+
+	// The version of the file format
+	Version int `json:"version"`
+
+	// The name of the site
+	Site string `json:"site"`
+
+	// How the calibration was estimated, e.g. "reference" or "clarity"
+	Method string `json:"method"`
+
+	// When the calibration was estimated
+	Created time.Time `json:"created"`
+
+	// The corrections, indexed by reader IP address
+	Readers map[string]*ReaderCalibration `json:"readers"`
+}
+
+// ReaderCalibration is the correction for one reader.
+type ReaderCalibration struct {
+
+	// Added to the scaled signal
+	Offset float64 `json:"offset"`
+
+	// Multiplies the signal, must be positive
+	Scale float64 `json:"scale"`
+
+	// The number of pings used to estimate the correction
+	N int `json:"n"`
+}
+
+// LoadCalibration reads and checks a calibration from a JSON file.
+func LoadCalibration(fname string) (*Calibration, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	cal, err := ReadCalibration(fid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return cal, nil
+}
+
+// ReadCalibration reads and checks a calibration in JSON format.
+func ReadCalibration(r io.Reader) (*Calibration, error) {
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	cal := new(Calibration)
+	if err := dec.Decode(cal); err != nil {
+		return nil, err
+	}
+
+	if cal.Version != CalibrationVersion {
+		return nil, fmt.Errorf("unsupported calibration version %d", cal.Version)
+	}
+
+	for ip, rc := range cal.Readers {
+		if rc == nil || !(rc.Scale > 0) || math.IsInf(rc.Scale, 0) || math.IsNaN(rc.Offset) || math.IsInf(rc.Offset, 0) {
+			return nil, fmt.Errorf("reader '%s': invalid calibration", ip)
+		}
+	}
+
+	return cal, nil
+}
+
+// Write writes the calibration in JSON format.
+func (cal *Calibration) Write(w io.Writer) error {
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(cal)
+}
+
+// Apply returns the calibrated value of a signal received by the reader with the
+// given IP address.
+func (cal *Calibration) Apply(ip string, signal float64) float64 {
+
+	rc, ok := cal.Readers[ip]
+	if !ok {
+		return signal
+	}
+
+	return rc.Scale*signal + rc.Offset
+}
+
+// CalibrationData collects the signals of pings from tags that are known to be in
+// the same room as the reader that received them.
+type CalibrationData struct {
+
+	// The signals, indexed by reader IP address
+	signals map[string][]float64
+}
+
+// NewCalibrationData returns a CalibrationData value with no pings.
+func NewCalibrationData() *CalibrationData {
+	return &CalibrationData{signals: make(map[string][]float64)}
+}
+
+// Add includes a ping with the given signal, received by the reader with the given
+// IP address from a tag in the same room.
+func (cd *CalibrationData) Add(ip string, signal float64) {
+	cd.signals[ip] = append(cd.signals[ip], signal)
+}
+
+// Estimate returns a calibration that gives the in-room signals of every reader
+// with at least minPings pings the same mean and standard deviation, which are the
+// averages of the means and standard deviations of those readers.  Readers with
+// fewer pings are not calibrated, and the scale of a reader is 1 if its signals do
+// not vary.
+func (cd *CalibrationData) Estimate(site, method string, minPings int) *Calibration {
+
+	cal := &Calibration{
+		Version: CalibrationVersion,
+		Site:    site,
+		Method:  method,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Readers: make(map[string]*ReaderCalibration),
+	}
+
+	// Visit the readers in a fixed order so that the result does not depend on
+	// the order of the map.
+	var ips []string
+	for ip, s := range cd.signals {
+		if len(s) >= minPings && len(s) > 0 {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	if len(ips) == 0 {
+		return cal
+	}
+
+	mean := make([]float64, len(ips))
+	sd := make([]float64, len(ips))
+	var tmean, tsd float64
+	var nsd int
+	for i, ip := range ips {
+		mean[i], sd[i] = meanSD(cd.signals[ip])
+		tmean += mean[i]
+		if sd[i] > 0 {
+			tsd += sd[i]
+			nsd++
+		}
+	}
+	tmean /= float64(len(ips))
+	if nsd > 0 {
+		tsd /= float64(nsd)
+	}
+
+	for i, ip := range ips {
+		scale := 1.0
+		if sd[i] > 0 {
+			scale = tsd / sd[i]
+		}
+		cal.Readers[ip] = &ReaderCalibration{
+			Offset: tmean - scale*mean[i],
+			Scale:  scale,
+			N:      len(cd.signals[ip]),
+		}
+	}
+
+	return cal
+}
+
+// meanSD returns the mean and standard deviation of a non-empty sample.  The standard
+// deviation is zero if there is only one value.
+func meanSD(x []float64) (float64, float64) {
+
+	var m float64
+	for _, v := range x {
+		m += v
+	}
+	m /= float64(len(x))
+
+	if len(x) < 2 {
+		return m, 0
+	}
+
+	var v float64
+	for _, y := range x {
+		v += (y - m) * (y - m)
+	}
+
+	return m, math.Sqrt(v / float64(len(x)-1))
+}
+
+// ReferenceTag is a tag that is left in one room, so that the pings it produces
+// can be used to calibrate the readers.
+type ReferenceTag struct {
+
+	// The tag as it appears in the raw data
+	Tag string `json:"tag"`
+
+	// The name of the room containing the tag
+	Room string `json:"room"`
+}
+
+// LoadReferenceTags reads a list of reference tags for a site from a JSON file.
+// Every room must be a physical room of the site.
+func LoadReferenceTags(fname string, site *SiteConfig) ([]*ReferenceTag, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	dec := json.NewDecoder(fid)
+	dec.DisallowUnknownFields()
+
+	var tags []*ReferenceTag
+	if err := dec.Decode(&tags); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		room := site.RoomByName(tag.Room)
+		if room == nil || room.Category == VirtualRoom {
+			return nil, fmt.Errorf("%s: reference tag '%s' is in unknown room '%s'", fname, tag.Tag, tag.Room)
+		}
+		if seen[tag.Tag] {
+			return nil, fmt.Errorf("%s: duplicate reference tag '%s'", fname, tag.Tag)
+		}
+		seen[tag.Tag] = true
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,117 @@
+package rfid
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Readers with different gains and offsets give the same in-room signal
+// distribution after calibration.
+func TestCalibrationEstimate(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(7))
+
+	cd := NewCalibrationData()
+	for _, r := range []struct {
+		ip    string
+		mean  float64
+		sd    float64
+		count int
+	}{
+		{"10.23.69.140", -60, 4, 2000},
+		{"10.23.69.141", -70, 8, 2000},
+		{"10.23.69.142", -50, 2, 2000},
+		{"10.23.69.143", -40, 1, 5},
+	} {
+		for i := 0; i < r.count; i++ {
+			cd.Add(r.ip, r.mean+r.sd*rng.NormFloat64())
+		}
+	}
+
+	cal := cd.Estimate("main", "reference", 100)
+
+	// Too few pings
+	if _, ok := cal.Readers["10.23.69.143"]; ok {
+		t.Errorf("reader with few pings was calibrated")
+	}
+	if cal.Apply("10.23.69.143", -40) != -40 {
+		t.Errorf("uncalibrated reader was changed")
+	}
+
+	// The calibrated means and standard deviations agree
+	for ip, rc := range cal.Readers {
+		m, s := meanSD(cd.signals[ip])
+		if math.Abs(rc.Scale*m+rc.Offset+60) > 0.2 {
+			t.Errorf("%s: calibrated mean %f, expected -60", ip, rc.Scale*m+rc.Offset)
+		}
+		if math.Abs(rc.Scale*s-14.0/3) > 0.2 {
+			t.Errorf("%s: calibrated standard deviation %f, expected %f", ip, rc.Scale*s, 14.0/3)
+		}
+	}
+
+	// Round trip through the file format
+	var buf bytes.Buffer
+	if err := cal.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	cal2, err := ReadCalibration(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cal2.Apply("10.23.69.141", -65) != cal.Apply("10.23.69.141", -65) {
+		t.Errorf("calibration changed when read back")
+	}
+
+	// Applied when parsing
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := site.SetCalibration(cal); err != nil {
+		t.Fatal(err)
+	}
+	var rec RFIDrecord
+	var rfi RFIDinfo
+	f := strings.Split("2023,10.23.69.141,00501F4F900000001F0318FX,2018-03-01 08:00:12,-63.5,4", ",")
+	if err := rec.Parse(f, site, &rfi); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(float64(rec.Signal)-cal.Apply("10.23.69.141", -63.5)) > 1e-4 {
+		t.Errorf("signal %f not calibrated", rec.Signal)
+	}
+}
+
+func TestCalibrationInvalid(t *testing.T) {
+
+	for _, s := range []string{
+		`{"version": 2, "site": "main", "readers": {}}`,
+		`{"version": 1, "site": "main", "readers": {"10.23.69.140": {"offset": 0, "scale": 0}}}`,
+		`{"version": 1, "site": "main", "readers": {"10.23.69.140": {"offset": 0, "scale": 1}}, "extra": 1}`,
+	} {
+		if _, err := ReadCalibration(strings.NewReader(s)); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		// Wrong site
+		`{"version": 1, "site": "other", "readers": {}}`,
+		// Unknown reader
+		`{"version": 1, "site": "main", "readers": {"10.0.0.1": {"offset": 0, "scale": 1}}}`,
+	} {
+		cal, err := ReadCalibration(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if site.SetCalibration(cal) == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package rfid
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // ClarityRecord contains extracted fields for one record of Clarity data.
 type ClarityRecord struct {
@@ -8,6 +11,9 @@ type ClarityRecord struct {
 	// Appointment identifier
 	CSN uint64
 
+	// The name of the site where the appointment took place
+	Site string
+
 	// Time of check-in
 	CheckInTime time.Time
 
@@ -33,7 +39,8 @@ type ClarityFileInfo struct {
 }
 
 // GetClarityFileInfo takes the header of a Clarity file and locates the columns of interest.
-func GetClarityFileInfo(head []string) *ClarityFileInfo {
+// If any column is missing, the returned error wraps ErrMissingColumn.
+func GetClarityFileInfo(head []string) (*ClarityFileInfo, error) {
 
 	col := make(map[string]int)
 	for j, n := range head {
@@ -42,32 +49,22 @@ func GetClarityFileInfo(head []string) *ClarityFileInfo {
 
 	finf := new(ClarityFileInfo)
 
-	var ok bool
-
-	finf.CSN, ok = col["PAT_ENC_CSN_ID"]
-	if !ok {
-		panic("Can't find PAT_ENC_CSN_ID\n")
-	}
-
-	finf.CheckInTime, ok = col["CHECKIN_DTTM"]
-	if !ok {
-		panic("Can't find CHECKIN_DTTM\n")
-	}
-
-	finf.CheckOutTime, ok = col["CHECKOUT_DTTM"]
-	if !ok {
-		panic("Can't find CHECKOUT_DTTM\n")
-	}
-
-	finf.ProvName, ok = col["PROV_NAME_WID"]
-	if !ok {
-		panic("Can't find PROV_NAME_WID\n")
-	}
-
-	finf.VfiOs, ok = col["VFI_OS"]
-	if !ok {
-		panic("Cant find VFI_OS")
+	for _, q := range []struct {
+		name string
+		pos  *int
+	}{
+		{"PAT_ENC_CSN_ID", &finf.CSN},
+		{"CHECKIN_DTTM", &finf.CheckInTime},
+		{"CHECKOUT_DTTM", &finf.CheckOutTime},
+		{"PROV_NAME_WID", &finf.ProvName},
+		{"VFI_OS", &finf.VfiOs},
+	} {
+		j, ok := col[q.name]
+		if !ok {
+			return nil, fmt.Errorf("%w %s", ErrMissingColumn, q.name)
+		}
+		*q.pos = j
 	}
 
-	return finf
+	return finf, nil
 }
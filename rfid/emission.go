@@ -0,0 +1,197 @@
+package rfid
+
+import "math"
+
+// The smallest and largest detection probabilities in a fitted SignalModel, so that
+// hearing or missing a room is never impossible.
+const (
+	minDetect = 0.01
+	maxDetect = 0.99
+)
+
+// signalPrior is the number of pseudo-observations that shrink the fitted detection
+// probabilities and mean log signals of a SignalModel towards their pooled values.
+const signalPrior = 5
+
+// SignalModel is a model for the signals heard in one time window given the room a
+// person is in.  The rooms are heard independently, and when a room is heard, the
+// log of its signal is normally distributed.
+type SignalModel struct {
+
+	// Detect[j][r] is the probability that room r is heard from a person in room
+	// j, indexed by room code.  Only the physical rooms are used.
+	Detect [][]float64
+
+	// Mean[j][r] is the mean log signal of room r when it is heard from a person
+	// in room j.
+	Mean [][]float64
+
+	// The standard deviation of the log signals
+	SD float64
+}
+
+// Likelihood returns the likelihood of the signals in each time window for each
+// state, for use with HMM.SetLikelihood.  Whether any signal is heard, and the
+// virtual states, use the discrete emission probabilities emis.
+func (m *SignalModel) Likelihood(locs []*Location, emis [][]float64) [][]float64 {
+
+	nstate := len(emis)
+	lik := alloc(len(locs), nstate)
+
+	// The log probability that nothing is heard from each room, and the log
+	// probability that at least one room is heard
+	base := make([]float64, nstate)
+	anyHeard := make([]float64, nstate)
+	for j := int(numVirtual); j < nstate; j++ {
+		for r := int(numVirtual); r < nstate; r++ {
+			base[j] += math.Log1p(-m.Detect[j][r])
+		}
+		anyHeard[j] = math.Log(-math.Expm1(base[j]))
+	}
+
+	// The probability of hearing some physical room in each state
+	q := make([]float64, nstate)
+	for j := range q {
+		for r := int(numVirtual); r < nstate; r++ {
+			q[j] += emis[j][r]
+		}
+	}
+
+	logg := make([]float64, nstate)
+	for t, loc := range locs {
+
+		if len(loc.Signals) == 0 {
+			for j := 0; j < nstate; j++ {
+				lik[t][j] = emis[j][loc.IP]
+			}
+			continue
+		}
+
+		// The log density of the signals given each physical room, conditional
+		// on some room being heard
+		mx := math.Inf(-1)
+		for j := int(numVirtual); j < nstate; j++ {
+			v := base[j] - anyHeard[j]
+			for _, rs := range loc.Signals {
+				p := m.Detect[j][rs.Room]
+				z := (math.Log(rs.Signal) - m.Mean[j][rs.Room]) / m.SD
+				v += math.Log(p) - math.Log1p(-p) - z*z/2 - math.Log(m.SD)
+			}
+			logg[j] = v
+			mx = math.Max(mx, v)
+		}
+
+		// Each time window can be scaled separately
+		g := lik[t]
+		for j := int(numVirtual); j < nstate; j++ {
+			g[j] = q[j] * math.Exp(logg[j]-mx)
+		}
+
+		// A virtual state is a mixture of the physical rooms, weighted by its
+		// emission probabilities.
+		for v := 0; v < int(numVirtual); v++ {
+			for r := int(numVirtual); r < nstate; r++ {
+				g[v] += emis[v][r] * math.Exp(logg[r]-mx)
+			}
+		}
+	}
+
+	return lik
+}
+
+// SignalStats accumulates the log signals heard from each room, by the room with the
+// strongest signal, to fit a SignalModel.
+type SignalStats struct {
+	n     []float64
+	heard [][]float64
+	sum   [][]float64
+	sumsq [][]float64
+}
+
+// NewSignalStats returns an empty SignalStats for a site with nstate states.
+func NewSignalStats(nstate int) *SignalStats {
+	return &SignalStats{
+		n:     make([]float64, nstate),
+		heard: alloc(nstate, nstate),
+		sum:   alloc(nstate, nstate),
+		sumsq: alloc(nstate, nstate),
+	}
+}
+
+// Add adds the signals of one time window.  Time windows with no signals are ignored.
+func (st *SignalStats) Add(loc *Location) {
+
+	if len(loc.Signals) == 0 || loc.IP < numVirtual {
+		return
+	}
+
+	j := loc.IP
+	st.n[j]++
+	for _, rs := range loc.Signals {
+		x := math.Log(rs.Signal)
+		st.heard[j][rs.Room]++
+		st.sum[j][rs.Room] += x
+		st.sumsq[j][rs.Room] += x * x
+	}
+}
+
+// Model returns the fitted SignalModel, or nil if no signals were added.  The room
+// with the strongest signal is taken to be the person's room, and the estimates for
+// each pair of rooms are shrunk towards the pooled estimates for the same room and
+// for different rooms.
+func (st *SignalStats) Model() *SignalModel {
+
+	nstate := len(st.n)
+
+	// Pooled counts for the same room (0) and different rooms (1)
+	var n, heard, sum [2]float64
+	var ss, df float64
+	for j := int(numVirtual); j < nstate; j++ {
+		for r := int(numVirtual); r < nstate; r++ {
+			g := 1
+			if j == r {
+				g = 0
+			}
+			n[g] += st.n[j]
+			heard[g] += st.heard[j][r]
+			sum[g] += st.sum[j][r]
+			if h := st.heard[j][r]; h > 0 {
+				ss += st.sumsq[j][r] - st.sum[j][r]*st.sum[j][r]/h
+				df += h - 1
+			}
+		}
+	}
+	if heard[0] == 0 {
+		return nil
+	}
+
+	var p0, mu0 [2]float64
+	for g := range p0 {
+		if heard[g] > 0 {
+			p0[g] = heard[g] / n[g]
+			mu0[g] = sum[g] / heard[g]
+		} else {
+			mu0[g] = mu0[0]
+		}
+	}
+
+	sd := 1.0
+	if df > 0 && ss > 0 {
+		sd = math.Sqrt(ss / df)
+	}
+
+	m := &SignalModel{Detect: alloc(nstate, nstate), Mean: alloc(nstate, nstate), SD: sd}
+	for j := int(numVirtual); j < nstate; j++ {
+		for r := int(numVirtual); r < nstate; r++ {
+			g := 1
+			if j == r {
+				g = 0
+			}
+			p := (st.heard[j][r] + signalPrior*p0[g]) / (st.n[j] + signalPrior)
+			m.Detect[j][r] = math.Min(math.Max(p, minDetect), maxDetect)
+			m.Mean[j][r] = (st.sum[j][r] + signalPrior*mu0[g]) / (st.heard[j][r] + signalPrior)
+		}
+	}
+
+	return m
+}
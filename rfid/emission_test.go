@@ -0,0 +1,186 @@
+package rfid
+
+import (
+	"math"
+	"testing"
+)
+
+// twoRoomEmission returns the discrete emission probabilities for a site with the
+// virtual states and two rooms.
+func twoRoomEmission() [][]float64 {
+
+	n := int(numVirtual) + 2
+	emis := alloc(n, n)
+	for j := range emis {
+		for k := range emis[j] {
+			emis[j][k] = 1
+		}
+		emis[j][j] = 10
+		tot := float64(n) + 9
+		for k := range emis[j] {
+			emis[j][k] /= tot
+		}
+	}
+
+	return emis
+}
+
+func TestSignalStats(t *testing.T) {
+
+	a, b := numVirtual, numVirtual+1
+	st := NewSignalStats(int(numVirtual) + 2)
+	for i := 0; i < 20; i++ {
+		loc := &Location{IP: a, Signals: []RoomSignal{{Room: a, Signal: math.Exp(2)}}}
+		if i%4 == 0 {
+			loc.Signals = append(loc.Signals, RoomSignal{Room: b, Signal: math.Exp(-1)})
+		}
+		st.Add(loc)
+	}
+	st.Add(&Location{IP: NoSignal})
+
+	m := st.Model()
+	if m == nil {
+		t.Fatal("no model was fit")
+	}
+	if m.Detect[a][a] != maxDetect || math.Abs(m.Detect[a][b]-0.25) > 1e-12 {
+		t.Errorf("got detection probabilities %v", m.Detect[a])
+	}
+	if math.Abs(m.Mean[a][a]-2) > 1e-12 || math.Abs(m.Mean[a][b]+1) > 1e-12 {
+		t.Errorf("got mean log signals %v", m.Mean[a])
+	}
+
+	// With no data for room b, its estimates are the pooled ones
+	if m.Detect[b][b] != maxDetect || math.Abs(m.Mean[b][a]+1) > 1e-12 {
+		t.Errorf("got detection probabilities %v and means %v for room b", m.Detect[b], m.Mean[b])
+	}
+
+	if NewSignalStats(5).Model() != nil {
+		t.Errorf("model fit without data")
+	}
+}
+
+// Two rooms with nearly equal signals give a less certain posterior than one room
+// with a much stronger signal, although the strongest room is the same.
+func TestSignalModel(t *testing.T) {
+
+	a, b := numVirtual, numVirtual+1
+	n := int(numVirtual) + 2
+	emis := twoRoomEmission()
+
+	m := &SignalModel{Detect: alloc(n, n), Mean: alloc(n, n), SD: 1}
+	for j := a; j <= b; j++ {
+		for r := a; r <= b; r++ {
+			m.Detect[j][r], m.Mean[j][r] = 0.5, -2
+		}
+		m.Detect[j][j], m.Mean[j][j] = 0.95, 0
+	}
+
+	trans := alloc(n, n)
+	for j := range trans {
+		for k := range trans[j] {
+			trans[j][k] = 0.1 / float64(n-1)
+		}
+		trans[j][j] = 0.9
+	}
+	start := make([]float64, n)
+	for j := range start {
+		start[j] = 1 / float64(n)
+	}
+
+	// The posterior probability of room a in the middle of three minutes with
+	// signals from both rooms, the first being stronger
+	post := func(weak float64, discrete bool) float64 {
+		var locs []*Location
+		for i := 0; i < 3; i++ {
+			locs = append(locs, &Location{IP: a, Signals: []RoomSignal{{Room: a, Signal: 1}, {Room: b, Signal: weak}}})
+		}
+		hmm := &HMM{}
+		hmm.SetTransmission(trans)
+		hmm.SetEmission(emis)
+		hmm.SetStart(start)
+		hmm.SetData([]int{int(a), int(a), int(a)})
+		if !discrete {
+			hmm.SetLikelihood(m.Likelihood(locs, emis))
+		}
+		if err := hmm.Fit(); err != nil {
+			t.Fatal(err)
+		}
+		return hmm.PostProb[1][a]
+	}
+
+	dominant, equal := post(math.Exp(-2), false), post(0.95, false)
+	if !(dominant > equal+0.05) {
+		t.Errorf("posterior of the strongest room is %f with a dominant signal and %f with nearly equal signals", dominant, equal)
+	}
+	if equal < 0.5 {
+		t.Errorf("posterior of the strongest room is only %f", equal)
+	}
+
+	// The strongest room alone can't tell the two cases apart
+	if d1, d2 := post(math.Exp(-2), true), post(0.95, true); d1 != d2 {
+		t.Errorf("discrete posteriors differ: %f %f", d1, d2)
+	}
+
+	// Time windows without signals use the discrete emission probabilities
+	lik := m.Likelihood([]*Location{{IP: NoSignal}}, emis)
+	for j := range lik[0] {
+		if lik[0][j] != emis[j][NoSignal] {
+			t.Errorf("state %d: likelihood %f without signals, expected %f", j, lik[0][j], emis[j][NoSignal])
+		}
+	}
+}
+
+// A likelihood matrix built from discrete data gives the same results as the data.
+func TestSetLikelihood(t *testing.T) {
+
+	emis := [][]float64{
+		[]float64{0.7, 0.2, 0.1},
+		[]float64{0.2, 0.6, 0.2},
+		[]float64{0.1, 0.3, 0.6},
+	}
+	trans := [][]float64{
+		[]float64{0.8, 0.1, 0.1},
+		[]float64{0.2, 0.7, 0.1},
+		[]float64{0.1, 0.2, 0.7},
+	}
+	start := []float64{0.5, 0.3, 0.2}
+	data := []int{0, 0, 1, 2, 2, 1, 0, 2, 2, 2}
+
+	h1 := HMM{}
+	h1.SetEmission(emis)
+	h1.SetTransmission(trans)
+	h1.SetStart(start)
+	h1.SetData(data)
+	if err := h1.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	lik := alloc(len(data), len(emis))
+	for i, d := range data {
+		for j := range emis {
+			lik[i][j] = emis[j][d]
+		}
+	}
+
+	h2 := HMM{}
+	h2.SetTransmission(trans)
+	h2.SetStart(start)
+	h2.SetLikelihood(lik)
+	if err := h2.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(h1.LogLik-h2.LogLik) > 1e-10 {
+		t.Errorf("log-likelihoods differ: %f %f", h1.LogLik, h2.LogLik)
+	}
+	for i := range data {
+		if h1.Pred[i] != h2.Pred[i] {
+			t.Errorf("predictions differ at %d", i)
+		}
+		for j := range emis {
+			if math.Abs(h1.PostProb[i][j]-h2.PostProb[i][j]) > 1e-10 {
+				t.Errorf("posterior probabilities differ at %d, %d", i, j)
+			}
+		}
+	}
+}
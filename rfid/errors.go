@@ -0,0 +1,69 @@
+package rfid
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMissingColumn is returned when a required column is not present in
+	// the header of a Clarity file.
+	ErrMissingColumn = errors.New("missing column")
+
+	// ErrDegenerateHMM is returned when every state of an HMM has zero probability
+	// at some time point, so the posterior probabilities are not defined.
+	ErrDegenerateHMM = errors.New("degenerate HMM")
+
+	// ErrDateFormat is wrapped by the parse errors for dates and time stamps in
+	// the raw data that are not in the expected format.
+	ErrDateFormat = errors.New("wrong date format")
+
+	// ErrFieldCount is wrapped by the parse errors for rows of raw data with too
+	// few fields.
+	ErrFieldCount = errors.New("too few fields")
+)
+
+// The reasons that a value in the raw data can't be parsed, other than the errors
+// from strconv.
+var (
+	errTagLength       = errors.New("tag has the wrong length")
+	errTagFields       = errors.New("tag has the wrong number of parts")
+	errInconsistentTag = errors.New("patient tag has a provider type")
+	errUnknownReader   = errors.New("unknown reader")
+)
+
+// ParseError records a value in an input file that could not be parsed.
+type ParseError struct {
+
+	// The name of the file, if known
+	File string
+
+	// The line number within the file, starting at 1, or 0 if not known
+	Line int
+
+	// The name of the field
+	Field string
+
+	// The text that could not be parsed
+	Value string
+
+	// The underlying error
+	Err error
+}
+
+func (e *ParseError) Error() string {
+
+	msg := fmt.Sprintf("invalid %s '%s': %v", e.Field, e.Value, e.Err)
+	switch {
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, msg)
+	case e.File != "":
+		return fmt.Sprintf("%s: %s", e.File, msg)
+	default:
+		return msg
+	}
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
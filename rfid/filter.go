@@ -0,0 +1,152 @@
+package rfid
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+)
+
+// Filter estimates the state of an HMM one observation at a time, for use while the
+// data are still arriving.  After each observation it provides the filtered
+// distribution of the current state, and a fixed-lag smoothed distribution of the
+// state a given number of time points earlier, which also uses the observations
+// since then.
+type Filter struct {
+
+	// The model parameters
+	hmm *HMM
+
+	// The transition probabilities
+	trans [][]float64
+
+	// The smoothed estimates are for this many time points before the most
+	// recent observation
+	lag int
+
+	// The filtered distributions for the most recent lag+1 time points
+	alpha [][]float64
+
+	// The likelihoods of the most recent lag+1 observations for each state
+	lik [][]float64
+
+	// The number of observations so far
+	nTime int
+
+	// The log-likelihood of the data so far
+	LogLik float64
+}
+
+// NewFilter returns a Filter that uses the start, transition and emission
+// probabilities of hmm, with smoothed estimates lag time points behind the
+// most recent observation.  The lag can't be negative.
+func NewFilter(hmm *HMM, lag int) (*Filter, error) {
+
+	if lag < 0 {
+		return nil, fmt.Errorf("filter lag %d is negative", lag)
+	}
+
+	return &Filter{hmm: hmm, trans: hmm.Transmission(), lag: lag}, nil
+}
+
+// Step adds the next observation, which is coded like the data of an HMM.  It returns
+// the distribution of the current state given the data so far, and the smoothed
+// distribution of the state lag time points ago, which is nil until there have been
+// more than lag observations.  An error wrapping ErrDegenerateHMM is returned if the
+// observation has zero probability, in which case the filter is not changed.
+func (f *Filter) Step(obs int) ([]float64, []float64, error) {
+
+	lik := make([]float64, len(f.hmm.emis))
+	for j := range lik {
+		lik[j] = f.hmm.emis[j][obs]
+	}
+
+	return f.StepLikelihood(lik)
+}
+
+// StepLikelihood is like Step, but the next observation is given by its likelihood
+// for each state, as in HMM.SetLikelihood.
+func (f *Filter) StepLikelihood(lik []float64) ([]float64, []float64, error) {
+
+	nState := len(f.trans)
+	a := make([]float64, nState)
+
+	if f.nTime == 0 {
+		for j := range a {
+			a[j] = f.hmm.start[j] * lik[j]
+		}
+	} else {
+		prev := f.alpha[len(f.alpha)-1]
+		for j := range a {
+			if lik[j] == 0 {
+				continue
+			}
+			for k, p := range prev {
+				a[j] += p * f.trans[k][j]
+			}
+			a[j] *= lik[j]
+		}
+	}
+
+	c := floats.Sum(a)
+	if c == 0 || math.IsNaN(c) {
+		return nil, nil, fmt.Errorf("%w: all states have zero probability at time %d", ErrDegenerateHMM, f.nTime)
+	}
+	floats.Scale(1/c, a)
+
+	f.LogLik += math.Log(c)
+	f.nTime++
+	f.alpha = append(f.alpha, a)
+	f.lik = append(f.lik, lik)
+	if len(f.alpha) > f.lag+1 {
+		f.alpha = f.alpha[1:]
+		f.lik = f.lik[1:]
+	}
+
+	filtered := append([]float64(nil), a...)
+
+	if len(f.alpha) <= f.lag {
+		return filtered, nil, nil
+	}
+
+	return filtered, f.smooth(), nil
+}
+
+// smooth returns the distribution of the state at the start of the window, given
+// all the data so far, using a backward pass over the window.
+func (f *Filter) smooth() []float64 {
+
+	nState := len(f.trans)
+
+	beta := make([]float64, nState)
+	for j := range beta {
+		beta[j] = 1
+	}
+
+	b := make([]float64, nState)
+	for s := len(f.alpha) - 2; s >= 0; s-- {
+		for j := range b {
+			b[j] = 0
+			for k := range beta {
+				b[j] += f.trans[j][k] * f.lik[s+1][k] * beta[k]
+			}
+		}
+
+		// Only the proportions matter
+		floats.Scale(1/floats.Sum(b), b)
+		beta, b = b, beta
+	}
+
+	post := make([]float64, nState)
+	for j := range post {
+		post[j] = f.alpha[0][j] * beta[j]
+	}
+	floats.Scale(1/floats.Sum(post), post)
+
+	return post
+}
+
+// Time returns the number of observations so far.
+func (f *Filter) Time() int {
+	return f.nTime
+}
@@ -0,0 +1,121 @@
+package rfid
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The filtered and fixed-lag smoothed estimates agree with fitting the HMM to the
+// data seen so far.
+func TestFilter(t *testing.T) {
+
+	emis := [][]float64{
+		[]float64{0.7, 0.2, 0.1},
+		[]float64{0.2, 0.6, 0.2},
+		[]float64{0.1, 0.3, 0.6},
+	}
+	trans := [][]float64{
+		[]float64{0.8, 0.2, 0},
+		[]float64{0.1, 0.7, 0.2},
+		[]float64{0.1, 0.2, 0.7},
+	}
+	start := []float64{0.5, 0.3, 0.2}
+
+	rng := rand.New(rand.NewSource(2))
+	_, data := simulate(rng, emis, trans, start, 50)
+
+	for _, lag := range []int{0, 1, 5} {
+
+		hmm := &HMM{}
+		hmm.SetEmission(emis)
+		hmm.SetTransmission(trans)
+		hmm.SetStart(start)
+
+		filter, err := NewFilter(hmm, lag)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, d := range data {
+
+			filtered, smoothed, err := filter.Step(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			batch := &HMM{}
+			batch.SetEmission(emis)
+			batch.SetTransmission(trans)
+			batch.SetStart(start)
+			batch.SetData(data[0 : i+1])
+			if err := batch.Fit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if math.Abs(filter.LogLik-batch.LogLik) > 1e-10 {
+				t.Errorf("lag %d, time %d: log-likelihood %f, expected %f", lag, i, filter.LogLik, batch.LogLik)
+			}
+
+			for j := range filtered {
+				if math.Abs(filtered[j]-batch.PostProb[i][j]) > 1e-10 {
+					t.Errorf("lag %d, time %d: filtered probabilities %v, expected %v", lag, i, filtered, batch.PostProb[i])
+					break
+				}
+			}
+
+			if i < lag {
+				if smoothed != nil {
+					t.Errorf("lag %d, time %d: unexpected smoothed estimate", lag, i)
+				}
+				continue
+			}
+
+			for j := range smoothed {
+				if math.Abs(smoothed[j]-batch.PostProb[i-lag][j]) > 1e-10 {
+					t.Errorf("lag %d, time %d: smoothed probabilities %v, expected %v", lag, i, smoothed, batch.PostProb[i-lag])
+					break
+				}
+			}
+		}
+
+		if filter.Time() != len(data) {
+			t.Errorf("filter has %d time points, expected %d", filter.Time(), len(data))
+		}
+	}
+}
+
+func TestFilterDegenerate(t *testing.T) {
+
+	hmm := &HMM{}
+	hmm.SetEmission([][]float64{[]float64{1, 0}, []float64{1, 0}})
+	hmm.SetTransmission([][]float64{[]float64{0.5, 0.5}, []float64{0.5, 0.5}})
+	hmm.SetStart([]float64{0.5, 0.5})
+
+	filter, err := NewFilter(hmm, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := filter.Step(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := filter.Step(1); !errors.Is(err, ErrDegenerateHMM) {
+		t.Errorf("expected ErrDegenerateHMM, got %v", err)
+	}
+	if filter.Time() != 1 {
+		t.Errorf("filter changed by an impossible observation")
+	}
+}
+
+func TestFilterNegativeLag(t *testing.T) {
+
+	hmm := &HMM{}
+	hmm.SetEmission([][]float64{[]float64{1, 0}, []float64{0, 1}})
+	hmm.SetTransmission([][]float64{[]float64{0.5, 0.5}, []float64{0.5, 0.5}})
+	hmm.SetStart([]float64{0.5, 0.5})
+
+	if _, err := NewFilter(hmm, -1); err == nil {
+		t.Errorf("negative lag was accepted")
+	}
+}
@@ -0,0 +1,263 @@
+package rfid
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// FloorPlan describes the layout of a site as a graph, with the rooms and the
+// passages between them as nodes, and edges joining adjacent nodes.  It determines
+// which rooms a person can reach between one minute and the next, and which of
+// those moves are allowed.
+type FloorPlan struct {
+
+	// Passages such as hallways, which connect rooms but have no readers
+	Passages []string `json:"passages,omitempty"`
+
+	// Pairs of adjacent rooms or passages
+	Edges []*Edge `json:"edges"`
+
+	// The greatest distance that a person can walk between consecutive minutes,
+	// in the same units as the edge distances
+	MaxWalk float64 `json:"max_walk"`
+
+	// Rules for moving directly from one room to another, including the virtual
+	// states.  The first rule that matches a move gives its weight, and moves
+	// that match no rule have weight 1.
+	Moves []*Move `json:"moves,omitempty"`
+}
+
+// Edge joins two adjacent rooms or passages, in both directions.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// The walking distance, e.g. in meters
+	Distance float64 `json:"distance"`
+
+	// The types of people ("patient", "provider") who can use this edge,
+	// everyone if empty
+	Persons []string `json:"persons,omitempty"`
+
+	// The parsed person types, nil if everyone can use the edge
+	persons map[PersonType]bool
+}
+
+// Move is a rule for moving directly from one room to another.  The rooms are
+// given by name, by category (e.g. "exam"), or as "*" for any room.
+type Move struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// The types of people ("patient", "provider") the rule applies to,
+	// everyone if empty
+	Persons []string `json:"persons,omitempty"`
+
+	// The weight of the move relative to the other moves out of the room,
+	// where 0 means that the move is not possible
+	Weight float64 `json:"weight"`
+
+	// The parsed person types, nil if the rule applies to everyone
+	persons map[PersonType]bool
+}
+
+// matchRoom returns true if the room is selected by a room name, category
+// label or "*" in a move rule.
+func matchRoom(pattern string, room *Room) bool {
+	return pattern == "*" || pattern == room.Name || pattern == room.Category.String()
+}
+
+// setupFloorPlan checks the floor plan, and calculates the shortest walking
+// distance between every pair of rooms for each type of person.
+func (site *SiteConfig) setupFloorPlan() error {
+
+	site.dist = nil
+	fp := site.FloorPlan
+	if fp == nil {
+		return nil
+	}
+
+	if fp.MaxWalk <= 0 {
+		return fmt.Errorf("floor plan: max_walk must be positive")
+	}
+
+	// The physical rooms are the first nodes, in the order of their codes
+	// (the virtual states come first and are not in the graph), followed by
+	// the passages.
+	node := make(map[string]int)
+	for _, room := range site.Rooms {
+		if room.Category != VirtualRoom {
+			node[room.Name] = int(room.Code - numVirtual)
+		}
+	}
+	nroom := len(node)
+	for _, name := range fp.Passages {
+		if _, ok := node[name]; ok {
+			return fmt.Errorf("floor plan: duplicate passage or room '%s'", name)
+		}
+		if _, ok := virtualCodes[name]; ok {
+			return fmt.Errorf("floor plan: '%s' is a virtual room", name)
+		}
+		node[name] = len(node)
+	}
+
+	used := make([]bool, len(node))
+	for _, e := range fp.Edges {
+		i, ok := node[e.From]
+		if !ok {
+			return fmt.Errorf("floor plan: unknown room or passage '%s'", e.From)
+		}
+		j, ok := node[e.To]
+		if !ok {
+			return fmt.Errorf("floor plan: unknown room or passage '%s'", e.To)
+		}
+		if e.Distance < 0 || math.IsNaN(e.Distance) {
+			return fmt.Errorf("floor plan: invalid distance %v from '%s' to '%s'", e.Distance, e.From, e.To)
+		}
+		var err error
+		if e.persons, err = parsePersons(e.Persons); err != nil {
+			return fmt.Errorf("floor plan: edge from '%s' to '%s': %v", e.From, e.To, err)
+		}
+		used[i], used[j] = true, true
+	}
+
+	// Catch rooms that were left out of the plan, which could otherwise only be
+	// reached through the virtual states.
+	for _, room := range site.Rooms {
+		if room.Category != VirtualRoom && !used[node[room.Name]] {
+			return fmt.Errorf("floor plan: room '%s' has no edges", room.Name)
+		}
+	}
+
+	for _, m := range fp.Moves {
+		for _, name := range []string{m.From, m.To} {
+			if !site.knownPattern(name) {
+				return fmt.Errorf("floor plan: move from '%s' to '%s': unknown room or category '%s'", m.From, m.To, name)
+			}
+		}
+		if m.Weight < 0 || math.IsNaN(m.Weight) || math.IsInf(m.Weight, 0) {
+			return fmt.Errorf("floor plan: move from '%s' to '%s': invalid weight %v", m.From, m.To, m.Weight)
+		}
+		var err error
+		if m.persons, err = parsePersons(m.Persons); err != nil {
+			return fmt.Errorf("floor plan: move from '%s' to '%s': %v", m.From, m.To, err)
+		}
+	}
+
+	site.dist = make(map[PersonType][][]float64)
+	for _, pt := range personTypeCodes {
+		site.dist[pt] = shortestPaths(fp.Edges, node, pt, nroom)
+	}
+
+	return nil
+}
+
+// knownPattern returns true if name is "*", a room name or a room category label.
+func (site *SiteConfig) knownPattern(name string) bool {
+
+	if name == "*" {
+		return true
+	}
+	if _, ok := site.byName[name]; ok {
+		return true
+	}
+	for _, label := range roomCategoryNames {
+		if name == label {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shortestPaths returns the shortest walking distances between the first nroom
+// nodes of the floor plan, using only the edges that people of type pt can use.
+func shortestPaths(edges []*Edge, node map[string]int, pt PersonType, nroom int) [][]float64 {
+
+	n := len(node)
+	dist := alloc(n, n)
+	for i := range dist {
+		for j := range dist[i] {
+			if i != j {
+				dist[i][j] = math.Inf(1)
+			}
+		}
+	}
+
+	for _, e := range edges {
+		if e.persons != nil && !e.persons[pt] {
+			continue
+		}
+		i, j := node[e.From], node[e.To]
+		dist[i][j] = math.Min(dist[i][j], e.Distance)
+		dist[j][i] = dist[i][j]
+	}
+
+	// Floyd-Warshall shortest paths
+	for k := 0; k < n; k++ {
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if d := dist[i][k] + dist[k][j]; d < dist[i][j] {
+					dist[i][j] = d
+				}
+			}
+		}
+	}
+
+	dist = dist[0:nroom]
+	for i := range dist {
+		dist[i] = dist[i][0:nroom]
+	}
+
+	return dist
+}
+
+// Distance returns the shortest walking distance between two physical rooms for
+// a person of type pt, which is infinite if they are not connected.  If there is
+// no floor plan, or either room is a virtual state, the distance is 0.
+func (site *SiteConfig) Distance(pt PersonType, a, b RoomCode) float64 {
+
+	if site.dist == nil || a < numVirtual || b < numVirtual {
+		return 0
+	}
+
+	return site.dist[pt][a-numVirtual][b-numVirtual]
+}
+
+// Reachable returns true if a person of type pt can move from room a to room b in
+// the time dt.  Moves to and from the virtual states are always possible, as are
+// all moves if there is no floor plan.
+func (site *SiteConfig) Reachable(pt PersonType, a, b RoomCode, dt time.Duration) bool {
+
+	if site.FloorPlan == nil {
+		return true
+	}
+
+	return site.Distance(pt, a, b) <= site.FloorPlan.MaxWalk*dt.Minutes()
+}
+
+// MoveWeight returns the weight of a person of type pt moving from room a to a
+// different room b in the time dt, relative to the other moves out of room a.
+// The weight is 0 if the person can't be in room b or can't reach it in time,
+// and otherwise is given by the first move rule of the floor plan that matches.
+// If there is no floor plan, every move allowed by the rooms has weight 1.
+func (site *SiteConfig) MoveWeight(pt PersonType, a, b RoomCode, dt time.Duration) float64 {
+
+	from, to := site.Room(a), site.Room(b)
+	if !to.Allows(pt) || !site.Reachable(pt, a, b, dt) {
+		return 0
+	}
+
+	if site.FloorPlan == nil {
+		return 1
+	}
+
+	for _, m := range site.FloorPlan.Moves {
+		if (m.persons == nil || m.persons[pt]) && matchRoom(m.From, from) && matchRoom(m.To, to) {
+			return m.Weight
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,194 @@
+package rfid
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// floorPlanSite returns the default site with a floor plan, in which the exam
+// rooms are along one hallway and the other rooms along another.
+func floorPlanSite(t *testing.T) *SiteConfig {
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp := &FloorPlan{
+		Passages: []string{"Hall1", "Hall2"},
+		MaxWalk:  30,
+		Edges:    []*Edge{{From: "Hall1", To: "Hall2", Distance: 40}},
+	}
+	for _, room := range site.Rooms {
+		if room.Category == VirtualRoom {
+			continue
+		}
+		hall := "Hall2"
+		if room.Category == ExamRoom {
+			hall = "Hall1"
+		}
+		fp.Edges = append(fp.Edges, &Edge{From: room.Name, To: hall, Distance: 5})
+	}
+	site.FloorPlan = fp
+
+	if err := site.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return site
+}
+
+func TestFloorPlan(t *testing.T) {
+
+	site := floorPlanSite(t)
+
+	code := func(name string) RoomCode {
+		return site.RoomByName(name).Code
+	}
+
+	for _, c := range []struct {
+		from, to  string
+		dist      float64
+		reachable bool
+	}{
+		{"Exam1", "Exam12", 10, true},
+		{"Field5", "Field1", 10, true},
+		{"Field5", "Exam1", 50, false},
+		{"Exam3", "Exam3", 0, true},
+		{"Exam1", "NoSignal", 0, true},
+		{"CheckoutFinal", "Field2", 0, true},
+	} {
+		d := site.Distance(Patient, code(c.from), code(c.to))
+		if d != c.dist {
+			t.Errorf("distance from %s to %s is %f, expected %f", c.from, c.to, d, c.dist)
+		}
+		if r := site.Reachable(Patient, code(c.from), code(c.to), time.Minute); r != c.reachable {
+			t.Errorf("%s to %s: reachable is %v, expected %v", c.from, c.to, r, c.reachable)
+		}
+	}
+
+	// Further in two minutes
+	if !site.Reachable(Patient, code("Field5"), code("Exam1"), 2*time.Minute) {
+		t.Errorf("Exam1 is not reachable from Field5 in two minutes")
+	}
+
+	// Unconnected rooms
+	site.FloorPlan.Edges = site.FloorPlan.Edges[1:]
+	if err := site.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if d := site.Distance(Patient, code("Field5"), code("Exam1")); !math.IsInf(d, 1) {
+		t.Errorf("distance between unconnected rooms is %f", d)
+	}
+
+	// Without a floor plan every room can be reached
+	site.FloorPlan = nil
+	if err := site.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !site.Reachable(Patient, code("Field5"), code("Exam1"), time.Minute) {
+		t.Errorf("room not reachable without a floor plan")
+	}
+}
+
+func TestFloorPlanValidate(t *testing.T) {
+
+	for _, c := range []struct {
+		edit func(fp *FloorPlan)
+		msg  string
+	}{
+		{func(fp *FloorPlan) { fp.MaxWalk = 0 }, "max_walk"},
+		{func(fp *FloorPlan) { fp.Edges[0].To = "Hall3" }, "unknown room or passage 'Hall3'"},
+		{func(fp *FloorPlan) { fp.Edges[0].Distance = -1 }, "invalid distance"},
+		{func(fp *FloorPlan) { fp.Passages = append(fp.Passages, "Exam1") }, "duplicate passage"},
+		{func(fp *FloorPlan) { fp.Passages = append(fp.Passages, "NoSignal") }, "virtual room"},
+		{func(fp *FloorPlan) { fp.Edges = fp.Edges[0 : len(fp.Edges)-1] }, "has no edges"},
+		{func(fp *FloorPlan) { fp.Edges[0].Persons = []string{"doctor"} }, "unknown person type"},
+		{func(fp *FloorPlan) { fp.Moves = []*Move{{From: "exam", To: "Exam13"}} }, "unknown room or category 'Exam13'"},
+		{func(fp *FloorPlan) { fp.Moves = []*Move{{From: "*", To: "exam", Weight: -1}} }, "invalid weight"},
+		{func(fp *FloorPlan) { fp.Moves = []*Move{{From: "*", To: "exam", Persons: []string{"doctor"}}} }, "unknown person type"},
+	} {
+		site := floorPlanSite(t)
+		c.edit(site.FloorPlan)
+		err := site.Validate()
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("expected error containing '%s', got %v", c.msg, err)
+		}
+	}
+}
+
+func TestMoveWeight(t *testing.T) {
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := func(name string) RoomCode {
+		return site.RoomByName(name).Code
+	}
+
+	for _, c := range []struct {
+		pt       PersonType
+		from, to string
+		weight   float64
+	}{
+		{Patient, "Exam1", "Exam2", 0},
+		{Patient, "Exam1", "Field1", 0}, // too far without the staff hallway
+		{Patient, "Exam7", "Field1", 1},
+		{Patient, "Field1", "Field2", 0},
+		{Patient, "Field1", "IOLMaster", 1},
+		{Patient, "Field1", "Lensometer", 0},
+		{Patient, "Admin", "Checkout", 0},
+		{Patient, "Exam1", "Checkin", 0},
+		{Patient, "Exam1", "CheckoutFinal", 10},
+		{Patient, "CheckoutFinal", "Exam1", 0},
+		{Patient, "Checkin", "Admin", 1},
+		{Patient, "NoSignal", "Exam1", 1},
+		{Provider, "Exam1", "Exam2", 1},
+		{Provider, "Exam1", "Field1", 1},
+		{Provider, "Field1", "Lensometer", 1},
+		{Provider, "Admin", "Checkout", 1},
+	} {
+		if w := site.MoveWeight(c.pt, code(c.from), code(c.to), time.Minute); w != c.weight {
+			t.Errorf("%s from %s to %s: weight is %v, expected %v", PTmap[c.pt], c.from, c.to, w, c.weight)
+		}
+	}
+
+	// Without a floor plan only the room rules apply
+	site.FloorPlan = nil
+	if err := site.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if w := site.MoveWeight(Patient, code("Exam1"), code("Exam2"), time.Minute); w != 1 {
+		t.Errorf("move between exam rooms has weight %v without a floor plan", w)
+	}
+	if w := site.MoveWeight(Patient, code("Exam1"), code("Lensometer"), time.Minute); w != 0 {
+		t.Errorf("move into the lensometer room has weight %v for a patient", w)
+	}
+}
+
+func TestRoomPersons(t *testing.T) {
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lens := site.RoomByName("Lensometer")
+	if lens.Allows(Patient) || !lens.Allows(Provider) {
+		t.Errorf("Lensometer should only allow providers")
+	}
+
+	exam := site.RoomByName("Exam1")
+	if !exam.Allows(Patient) || !exam.Allows(Provider) {
+		t.Errorf("Exam1 should allow everyone")
+	}
+
+	exam.Persons = []string{"doctor"}
+	if err := site.Validate(); err == nil || !strings.Contains(err.Error(), "unknown person type") {
+		t.Errorf("expected unknown person type error, got %v", err)
+	}
+}
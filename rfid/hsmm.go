@@ -0,0 +1,456 @@
+package rfid
+
+import (
+	"fmt"
+	"math"
+)
+
+// HSMM represents a hidden semi-Markov model.  Unlike an HMM, the number of consecutive
+// time points spent in a state (the dwell time) has an explicit distribution for each
+// state, rather than the geometric distribution implied by the self-transition
+// probabilities.  The last dwell time is censored at the end of the data.
+type HSMM struct {
+
+	// The data sequence, coded 0, 1, ...
+	data []int
+
+	// The emission probabilities
+	emis [][]float64
+
+	// The likelihood of the observation at each time point for each state,
+	// used in place of data and emis if set
+	lik [][]float64
+
+	// The marginal distribution of the first state
+	start []float64
+
+	// The transition probabilities between states
+	trans [][]float64
+
+	// The dwell time probabilities, dur[j][u-1] is the probability of spending
+	// exactly u time points in state j
+	dur [][]float64
+
+	// The log-likelihood of the data
+	LogLik float64
+
+	// Posterior probabilities
+	PostProb [][]float64
+
+	// The most likely state sequence
+	Pred []int
+
+	// Number of time points
+	nTime int
+
+	// Number of states
+	nState int
+
+	// Log emission probabilities, indexed by time and state
+	lemis [][]float64
+
+	// Log transition probabilities, excluding self-transitions
+	ltrans [][]float64
+
+	// Log dwell time probabilities, and log probabilities of the dwell time being
+	// at least u
+	ldur  [][]float64
+	lsurv [][]float64
+
+	// Log probability of the data before t, and a dwell in state j starting at t
+	fbegin [][]float64
+
+	// Log probability of the data up to t, and a dwell in state j ending at t
+	fend [][]float64
+
+	// Log probability of the data from t on, given a dwell in state j starting at t
+	bbegin [][]float64
+
+	// Log probability of the data after t, given a dwell in state j ending at t
+	bend [][]float64
+}
+
+// NegBinomDuration returns dwell time probabilities for 1, ..., max time points, where
+// the dwell time minus 1 follows a negative binomial distribution, so that the dwell
+// time has the given mean.  Smaller values of size give more dispersed dwell times.
+// The distribution is truncated at max and rescaled to sum to 1.  An error is returned
+// if max or size is not positive, or the mean is not a number.
+func NegBinomDuration(mean, size float64, max int) ([]float64, error) {
+
+	if max <= 0 {
+		return nil, fmt.Errorf("maximum dwell time %d is not positive", max)
+	}
+	if !(size > 0) || math.IsInf(size, 1) {
+		return nil, fmt.Errorf("negative binomial size %v is not positive and finite", size)
+	}
+	if math.IsNaN(mean) || math.IsInf(mean, 0) {
+		return nil, fmt.Errorf("mean dwell time %v is not finite", mean)
+	}
+
+	dur := make([]float64, max)
+
+	mu := mean - 1
+	if mu <= 0 {
+		dur[0] = 1
+		return dur, nil
+	}
+
+	p := size / (size + mu)
+	lgs, _ := math.Lgamma(size)
+
+	var tot float64
+	for k := range dur {
+		a, _ := math.Lgamma(float64(k) + size)
+		b, _ := math.Lgamma(float64(k) + 1)
+		dur[k] = math.Exp(a - lgs - b + size*math.Log(p) + float64(k)*math.Log1p(-p))
+		tot += dur[k]
+	}
+
+	for k := range dur {
+		dur[k] /= tot
+	}
+
+	return dur, nil
+}
+
+// EmpiricalDuration returns dwell time probabilities proportional to a histogram,
+// counts[u-1] is the number of dwell times of u time points.
+func EmpiricalDuration(counts []float64) []float64 {
+
+	var tot float64
+	for _, c := range counts {
+		tot += c
+	}
+
+	dur := make([]float64, len(counts))
+	for k, c := range counts {
+		dur[k] = c / tot
+	}
+
+	return dur
+}
+
+// logadd returns log(exp(x) + exp(y)).
+func logadd(x, y float64) float64 {
+
+	if x < y {
+		x, y = y, x
+	}
+	if math.IsInf(y, -1) {
+		return x
+	}
+
+	return x + math.Log1p(math.Exp(y-x))
+}
+
+// SetEmission sets the emission probabilities.
+func (hsmm *HSMM) SetEmission(emis [][]float64) {
+	hsmm.emis = emis
+}
+
+// SetLikelihood sets the likelihood of the observation at each time point for each
+// state, lik[t][j] for time t and state j.  This is used in place of the data and
+// emission probabilities.
+func (hsmm *HSMM) SetLikelihood(lik [][]float64) {
+	hsmm.lik = lik
+}
+
+// SetTransmission sets the transition probability matrix.  The self-transition
+// probabilities are ignored, and the remaining probabilities in each row are
+// rescaled, since the time spent in a state is given by the dwell time distribution.
+func (hsmm *HSMM) SetTransmission(trans [][]float64) {
+	hsmm.trans = trans
+}
+
+// SetDuration sets the dwell time probabilities for each state, dur[j][u-1] is the
+// probability of spending exactly u time points in state j.  The dwell time can't
+// exceed len(dur[j]), except for the last state, which may be cut short by the end
+// of the data.
+func (hsmm *HSMM) SetDuration(dur [][]float64) {
+	hsmm.dur = dur
+}
+
+// SetData sets the data to which the HSMM will be fit.
+func (hsmm *HSMM) SetData(data []int) {
+	hsmm.data = data
+}
+
+// SetStart sets the starting probability distribution.
+func (hsmm *HSMM) SetStart(start []float64) {
+	hsmm.start = start
+}
+
+// setup calculates the log probabilities used by the forward, backward and Viterbi
+// passes.
+func (hsmm *HSMM) setup() {
+
+	hsmm.lemis = alloc(hsmm.nTime, hsmm.nState)
+	for t := 0; t < hsmm.nTime; t++ {
+		for j := 0; j < hsmm.nState; j++ {
+			if hsmm.lik != nil {
+				hsmm.lemis[t][j] = math.Log(hsmm.lik[t][j])
+			} else {
+				hsmm.lemis[t][j] = math.Log(hsmm.emis[j][hsmm.data[t]])
+			}
+		}
+	}
+
+	hsmm.ltrans = alloc(hsmm.nState, hsmm.nState)
+	for j := 0; j < hsmm.nState; j++ {
+		var tot float64
+		for k, p := range hsmm.trans[j] {
+			if k != j {
+				tot += p
+			}
+		}
+		for k, p := range hsmm.trans[j] {
+			if k == j || tot == 0 {
+				hsmm.ltrans[j][k] = math.Inf(-1)
+			} else {
+				hsmm.ltrans[j][k] = math.Log(p / tot)
+			}
+		}
+	}
+
+	hsmm.ldur = make([][]float64, hsmm.nState)
+	hsmm.lsurv = make([][]float64, hsmm.nState)
+	for j, dur := range hsmm.dur {
+		hsmm.ldur[j] = make([]float64, len(dur))
+		hsmm.lsurv[j] = make([]float64, len(dur))
+		surv := 1.0
+		for k, p := range dur {
+			hsmm.ldur[j][k] = math.Log(p)
+			hsmm.lsurv[j][k] = math.Log(math.Max(surv, 0))
+			surv -= p
+		}
+	}
+}
+
+// dwell returns the log probability of the data for dwells in state j that end at time
+// t, combined over the possible starting times s with weights fb[s][j], using the log
+// dwell time probabilities ld.
+func (hsmm *HSMM) dwell(t, j int, fb [][]float64, ld []float64) float64 {
+
+	acc := math.Inf(-1)
+	var le float64
+	for u := 1; u <= len(ld) && u <= t+1; u++ {
+		s := t - u + 1
+		le += hsmm.lemis[s][j]
+		if math.IsInf(le, -1) {
+			break
+		}
+		acc = logadd(acc, fb[s][j]+le+ld[u-1])
+	}
+
+	return acc
+}
+
+// forward calculates the forward probabilities and the log-likelihood.
+func (hsmm *HSMM) forward() error {
+
+	hsmm.fbegin = alloc(hsmm.nTime, hsmm.nState)
+	hsmm.fend = alloc(hsmm.nTime, hsmm.nState)
+
+	for t := 0; t < hsmm.nTime; t++ {
+		for j := 0; j < hsmm.nState; j++ {
+			if t == 0 {
+				hsmm.fbegin[t][j] = math.Log(hsmm.start[j])
+				continue
+			}
+			acc := math.Inf(-1)
+			for i := 0; i < hsmm.nState; i++ {
+				acc = logadd(acc, hsmm.fend[t-1][i]+hsmm.ltrans[i][j])
+			}
+			hsmm.fbegin[t][j] = acc
+		}
+
+		for j := 0; j < hsmm.nState; j++ {
+			hsmm.fend[t][j] = hsmm.dwell(t, j, hsmm.fbegin, hsmm.ldur[j])
+		}
+	}
+
+	// The last dwell is censored
+	hsmm.LogLik = math.Inf(-1)
+	for j := 0; j < hsmm.nState; j++ {
+		hsmm.LogLik = logadd(hsmm.LogLik, hsmm.dwell(hsmm.nTime-1, j, hsmm.fbegin, hsmm.lsurv[j]))
+	}
+
+	if math.IsInf(hsmm.LogLik, -1) || math.IsNaN(hsmm.LogLik) {
+		return fmt.Errorf("%w: the data have zero probability", ErrDegenerateHMM)
+	}
+
+	return nil
+}
+
+// backward calculates the backward probabilities.
+func (hsmm *HSMM) backward() {
+
+	hsmm.bbegin = alloc(hsmm.nTime, hsmm.nState)
+	hsmm.bend = alloc(hsmm.nTime, hsmm.nState)
+
+	last := hsmm.nTime - 1
+	for t := last; t >= 0; t-- {
+
+		for j := 0; j < hsmm.nState; j++ {
+			acc := math.Inf(-1)
+			if t < last {
+				for k := 0; k < hsmm.nState; k++ {
+					acc = logadd(acc, hsmm.ltrans[j][k]+hsmm.bbegin[t+1][k])
+				}
+			}
+			hsmm.bend[t][j] = acc
+		}
+
+		for j := 0; j < hsmm.nState; j++ {
+			acc := math.Inf(-1)
+			var le float64
+			for u := 1; u <= len(hsmm.ldur[j]) && t+u-1 <= last; u++ {
+				e := t + u - 1
+				le += hsmm.lemis[e][j]
+				if math.IsInf(le, -1) {
+					break
+				}
+				if e == last {
+					acc = logadd(acc, le+hsmm.lsurv[j][u-1])
+				} else {
+					acc = logadd(acc, le+hsmm.ldur[j][u-1]+hsmm.bend[e][j])
+				}
+			}
+			hsmm.bbegin[t][j] = acc
+		}
+	}
+}
+
+// getPost calculates the conditional probabilities of the state sequence given the
+// data.  The probability of being in state j at time t is the probability that a
+// dwell in state j started at or before t, minus the probability that one ended
+// before t.
+func (hsmm *HSMM) getPost() {
+
+	hsmm.PostProb = alloc(hsmm.nTime, hsmm.nState)
+
+	for j := 0; j < hsmm.nState; j++ {
+		var p float64
+		for t := 0; t < hsmm.nTime; t++ {
+			p += math.Exp(hsmm.fbegin[t][j] + hsmm.bbegin[t][j] - hsmm.LogLik)
+			if t > 0 {
+				p -= math.Exp(hsmm.fend[t-1][j] + hsmm.bend[t-1][j] - hsmm.LogLik)
+			}
+			hsmm.PostProb[t][j] = math.Min(math.Max(p, 0), 1)
+		}
+	}
+
+	for t := 0; t < hsmm.nTime; t++ {
+		var tot float64
+		for _, p := range hsmm.PostProb[t] {
+			tot += p
+		}
+		for j := range hsmm.PostProb[t] {
+			hsmm.PostProb[t][j] /= tot
+		}
+	}
+}
+
+// viterbi calculates the most likely state sequence.
+func (hsmm *HSMM) viterbi() {
+
+	last := hsmm.nTime - 1
+
+	// Best log probability of a dwell in state j starting or ending at t, with the
+	// previous state, and the dwell time.
+	vbegin := alloc(hsmm.nTime, hsmm.nState)
+	vend := alloc(hsmm.nTime, hsmm.nState)
+	prev := alloci(hsmm.nTime, hsmm.nState)
+	dwell := alloci(hsmm.nTime, hsmm.nState)
+
+	// best finds the most likely dwell in state j ending at t.
+	best := func(t, j int, ld []float64) (float64, int) {
+		q, bu := math.Inf(-1), 0
+		var le float64
+		for u := 1; u <= len(ld) && u <= t+1; u++ {
+			s := t - u + 1
+			le += hsmm.lemis[s][j]
+			if math.IsInf(le, -1) {
+				break
+			}
+			if v := vbegin[s][j] + le + ld[u-1]; v > q {
+				q, bu = v, u
+			}
+		}
+		return q, bu
+	}
+
+	for t := 0; t <= last; t++ {
+		for j := 0; j < hsmm.nState; j++ {
+			if t == 0 {
+				vbegin[t][j] = math.Log(hsmm.start[j])
+				continue
+			}
+			q, l := math.Inf(-1), 0
+			for i := 0; i < hsmm.nState; i++ {
+				if v := vend[t-1][i] + hsmm.ltrans[i][j]; v > q {
+					q, l = v, i
+				}
+			}
+			vbegin[t][j] = q
+			prev[t][j] = l
+		}
+
+		for j := 0; j < hsmm.nState; j++ {
+			vend[t][j], dwell[t][j] = best(t, j, hsmm.ldur[j])
+		}
+	}
+
+	// The last dwell is censored
+	q, j, u := math.Inf(-1), 0, 1
+	for k := 0; k < hsmm.nState; k++ {
+		if v, w := best(last, k, hsmm.lsurv[k]); v > q {
+			q, j, u = v, k, w
+		}
+	}
+
+	// Trace back through the dwells
+	hsmm.Pred = make([]int, hsmm.nTime)
+	t := last
+	for {
+		s := t - u + 1
+		for r := s; r <= t; r++ {
+			hsmm.Pred[r] = j
+		}
+		if s <= 0 || u < 1 {
+			break
+		}
+		j = prev[s][j]
+		t = s - 1
+		u = dwell[t][j]
+	}
+}
+
+// Fit calculates the posterior probabilities and most likely state sequence of the
+// HSMM based on the data.  An error wrapping ErrDegenerateHMM is returned if the data
+// have zero probability under the model.
+func (hsmm *HSMM) Fit() error {
+
+	hsmm.nTime = len(hsmm.data)
+	if hsmm.lik != nil {
+		hsmm.nTime = len(hsmm.lik)
+	}
+	hsmm.nState = len(hsmm.trans)
+
+	if hsmm.nTime == 0 {
+		return fmt.Errorf("HSMM has no data")
+	}
+	if len(hsmm.dur) != hsmm.nState {
+		return fmt.Errorf("HSMM has %d dwell time distributions for %d states", len(hsmm.dur), hsmm.nState)
+	}
+
+	hsmm.setup()
+	if err := hsmm.forward(); err != nil {
+		return err
+	}
+	hsmm.backward()
+	hsmm.getPost()
+	hsmm.viterbi()
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package rfid
+
+import (
+	"math"
+	"testing"
+)
+
+// pathHSMM returns the log probability of a state sequence and the data under an HSMM.
+func pathHSMM(states, data []int, emis, trans, dur [][]float64, start []float64) float64 {
+
+	lp := math.Log(start[states[0]])
+	u := 0
+	for t := range states {
+		lp += math.Log(emis[states[t]][data[t]])
+		u++
+
+		j := states[t]
+		if t == len(states)-1 {
+			// Censored last dwell
+			surv := 1.0
+			for k := 0; k < u-1 && k < len(dur[j]); k++ {
+				surv -= dur[j][k]
+			}
+			if u > len(dur[j]) {
+				surv = 0
+			}
+			lp += math.Log(surv)
+		} else if states[t+1] != j {
+			if u > len(dur[j]) {
+				return math.Inf(-1)
+			}
+			lp += math.Log(dur[j][u-1])
+			var tot float64
+			for k, p := range trans[j] {
+				if k != j {
+					tot += p
+				}
+			}
+			lp += math.Log(trans[j][states[t+1]] / tot)
+			u = 0
+		}
+	}
+
+	return lp
+}
+
+// Compare to the results obtained by enumerating all state sequences.
+func TestHSMMBrute(t *testing.T) {
+
+	emis := [][]float64{
+		[]float64{0.7, 0.2, 0.1},
+		[]float64{0.2, 0.6, 0.2},
+		[]float64{0.1, 0.3, 0.6},
+	}
+	trans := [][]float64{
+		[]float64{0.5, 0.3, 0.2},
+		[]float64{0.4, 0.2, 0.4},
+		[]float64{0.3, 0.7, 0},
+	}
+	nb, err := NegBinomDuration(2, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dur := [][]float64{
+		[]float64{0.1, 0.6, 0.3},
+		EmpiricalDuration([]float64{1, 1, 2, 4}),
+		nb,
+	}
+	start := []float64{0.5, 0.3, 0.2}
+	data := []int{0, 0, 1, 2, 2, 1, 0}
+
+	hsmm := HSMM{}
+	hsmm.SetEmission(emis)
+	hsmm.SetTransmission(trans)
+	hsmm.SetDuration(dur)
+	hsmm.SetStart(start)
+	hsmm.SetData(data)
+	if err := hsmm.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(data)
+	ns := len(emis)
+	states := make([]int, n)
+	post := alloc(n, ns)
+	tot := math.Inf(-1)
+	best := math.Inf(-1)
+	var pred []int
+
+	// Enumerate the state sequences as base ns integers
+	for m := 0; m < int(math.Pow(float64(ns), float64(n))); m++ {
+		x := m
+		for t := range states {
+			states[t] = x % ns
+			x /= ns
+		}
+
+		lp := pathHSMM(states, data, emis, trans, dur, start)
+		if math.IsInf(lp, -1) {
+			continue
+		}
+		tot = logadd(tot, lp)
+		for t, j := range states {
+			post[t][j] += math.Exp(lp)
+		}
+		if lp > best {
+			best = lp
+			pred = append(pred[0:0], states...)
+		}
+	}
+
+	if math.Abs(hsmm.LogLik-tot) > 1e-10 {
+		t.Errorf("log-likelihood is %f, expected %f", hsmm.LogLik, tot)
+	}
+
+	for i := range post {
+		for j := range post[i] {
+			p := post[i][j] / math.Exp(tot)
+			if math.Abs(hsmm.PostProb[i][j]-p) > 1e-8 {
+				t.Errorf("posterior probability %d, %d is %f, expected %f", i, j, hsmm.PostProb[i][j], p)
+			}
+		}
+	}
+
+	for i := range pred {
+		if hsmm.Pred[i] != pred[i] {
+			t.Errorf("predicted states %v, expected %v", hsmm.Pred, pred)
+			break
+		}
+	}
+}
+
+// With geometric dwell times an HSMM is an HMM.
+func TestHSMMGeometric(t *testing.T) {
+
+	emis := [][]float64{
+		[]float64{0.7, 0.2, 0.1},
+		[]float64{0.2, 0.6, 0.2},
+		[]float64{0.1, 0.3, 0.6},
+	}
+	stay := []float64{0.8, 0.6, 0.9}
+	other := [][]float64{
+		[]float64{0, 0.4, 0.6},
+		[]float64{0.5, 0, 0.5},
+		[]float64{0.9, 0.1, 0},
+	}
+	start := []float64{0.4, 0.4, 0.2}
+	data := []int{0, 0, 1, 2, 2, 1, 0, 2, 2, 2, 1, 1, 0, 0, 0, 2, 1, 2, 2, 0}
+
+	trans := alloc(3, 3)
+	dur := alloc(3, len(data))
+	for j := range trans {
+		for k := range trans[j] {
+			if j == k {
+				trans[j][k] = stay[j]
+			} else {
+				trans[j][k] = (1 - stay[j]) * other[j][k]
+			}
+		}
+		for u := range dur[j] {
+			dur[j][u] = (1 - stay[j]) * math.Pow(stay[j], float64(u))
+		}
+	}
+
+	hmm := HMM{}
+	hmm.SetEmission(emis)
+	hmm.SetTransmission(trans)
+	hmm.SetStart(start)
+	hmm.SetData(data)
+	if err := hmm.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	hsmm := HSMM{}
+	hsmm.SetEmission(emis)
+	hsmm.SetTransmission(trans)
+	hsmm.SetDuration(dur)
+	hsmm.SetStart(start)
+	hsmm.SetData(data)
+	if err := hsmm.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(hmm.LogLik-hsmm.LogLik) > 1e-10 {
+		t.Errorf("log-likelihoods differ: %f %f", hmm.LogLik, hsmm.LogLik)
+	}
+
+	for i := range data {
+		if hmm.Pred[i] != hsmm.Pred[i] {
+			t.Errorf("predictions differ at %d", i)
+		}
+		for j := range emis {
+			if math.Abs(hmm.PostProb[i][j]-hsmm.PostProb[i][j]) > 1e-10 {
+				t.Errorf("posterior probabilities differ at %d, %d", i, j)
+			}
+		}
+	}
+}
+
+func TestNegBinomDuration(t *testing.T) {
+
+	dur, err := NegBinomDuration(10, 3, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tot, mean float64
+	for k, p := range dur {
+		tot += p
+		mean += float64(k+1) * p
+	}
+
+	if math.Abs(tot-1) > 1e-12 {
+		t.Errorf("probabilities sum to %f", tot)
+	}
+	if math.Abs(mean-10) > 1e-6 {
+		t.Errorf("mean dwell time is %f, expected 10", mean)
+	}
+}
+
+// A mean dwell time of 1 puts all the probability on 1.
+func TestNegBinomDurationOne(t *testing.T) {
+
+	dur, err := NegBinomDuration(1, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dur[0] != 1 || dur[1] != 0 {
+		t.Errorf("got dwell time probabilities %v", dur)
+	}
+}
+
+func TestNegBinomDurationInvalid(t *testing.T) {
+
+	for _, c := range []struct {
+		mean, size float64
+		max        int
+	}{
+		{10, 3, 0},
+		{10, 3, -1},
+		{10, 0, 20},
+		{10, -2, 20},
+		{10, math.NaN(), 20},
+		{math.NaN(), 3, 20},
+	} {
+		if _, err := NegBinomDuration(c.mean, c.size, c.max); err == nil {
+			t.Errorf("mean %v, size %v, max %d: expected an error", c.mean, c.size, c.max)
+		}
+	}
+}
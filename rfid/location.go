@@ -2,35 +2,42 @@ package rfid
 
 import (
 	"math"
+	"sort"
 	"time"
 )
 
-const (
-	// Aggregate the signals over this time window.
-	twindow time.Duration = 1 * time.Minute
-)
-
 // Location describes the predicted location for a person at a given minute.
 type Location struct {
 
+	// The name of the site, room codes are specific to the site
+	Site string
+
 	// The id of the tag being located
 	TagId uint64
 
-	// The time for the location prediction
+	// The start of the time window for the location prediction
 	TimeStamp time.Time
 
+	// The length of the time window, 0 for one minute
+	Window time.Duration
+
 	// The numeric code for the location with highest signal
 	IP RoomCode
 
 	// The highest signal strength
 	Signal float64
 
-	// The numeric code for the location with second highest signal
+	// The numeric code for the location with second highest signal, Null if only
+	// one room has a signal
 	IP2 RoomCode
 
 	// The second highest signal
 	Signal2 float64
 
+	// The rooms with a nonzero signal, ranked from the highest signal to the lowest,
+	// at most LocationOptions.TopK of them
+	Signals []RoomSignal
+
 	// The Clarity record number for the appointment
 	CSN uint64
 
@@ -46,106 +53,189 @@ type Location struct {
 	// The predicted location from an HMM
 	IPhmm RoomCode
 
+	// The posterior probability of the HMM location, 0 if the HMM could not be fit
+	PostHMM float64
+
+	// The location other than IPhmm with the highest posterior probability
+	IPhmm2 RoomCode
+
+	// The posterior probability of IPhmm2
+	PostHMM2 float64
+
+	// The entropy (in nats) of the posterior distribution of the location,
+	// 0 if the location is certain
+	EntropyHMM float64
+
 	// True if the provider is in a room with a patient, or if a patient is
 	// in a room with a provider.
 	Match bool
 }
 
-// GetLocation returns an array of location predictions corresponding to the provided RFID records.
-func GetLocation(recs []*RFIDrecord) []*Location {
+// SetPosterior sets the HMM location to pred, and sets the confidence measures from
+// the posterior probabilities of all the locations.
+func (loc *Location) SetPosterior(pred RoomCode, post []float64) {
+
+	loc.IPhmm = pred
+	loc.PostHMM = post[pred]
+
+	loc.IPhmm2 = Null
+	loc.PostHMM2 = 0
+	loc.EntropyHMM = 0
+	for j, p := range post {
+		if p > 0 {
+			loc.EntropyHMM -= p * math.Log(p)
+		}
+		if RoomCode(j) != pred && p > loc.PostHMM2 {
+			loc.IPhmm2 = RoomCode(j)
+			loc.PostHMM2 = p
+		}
+	}
+}
+
+// WindowLength returns the length of the time window of the location.
+func (loc *Location) WindowLength() time.Duration {
+
+	if loc.Window == 0 {
+		return time.Minute
+	}
+
+	return loc.Window
+}
+
+// RoomSignal is the combined signal strength for one room during one time window.
+type RoomSignal struct {
+	Room   RoomCode
+	Signal float64
+
+	// The fraction of the total signal in the time window coming from this room
+	Share float32
+}
+
+// GetLocation returns an array of location predictions corresponding to the provided
+// RFID records, which must be sorted by time.  The locations are sorted by tag id and
+// then by time.  The room codes of the records are those allocated by the given site
+// configuration.  If opts is nil, DefaultLocationOptions is used, otherwise an error
+// is returned if the options are invalid.
+func GetLocation(recs []*RFIDrecord, site *SiteConfig, opts *LocationOptions) ([]*Location, error) {
+
+	if opts == nil {
+		opts = DefaultLocationOptions()
+	}
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
 
 	var alocs []*Location
 
-	// Process each minute as a chunk.
+	// Process each time window as a chunk.
 	for ii := 0; ii < len(recs); {
 
-		t0 := recs[ii].TimeStamp.Truncate(twindow)
+		t0 := recs[ii].TimeStamp.Truncate(opts.Window)
 
-		// Step through to the end of the minute
+		// Step through to the end of the window
 		jj := ii + 1
-		for jj < len(recs) && t0.Equal(recs[jj].TimeStamp.Truncate(twindow)) {
+		for jj < len(recs) && t0.Equal(recs[jj].TimeStamp.Truncate(opts.Window)) {
 			jj++
 		}
 
-		locs := processMinute(recs[ii:jj])
+		locs := processWindow(recs[ii:jj], site.NumRooms(), opts)
 		alocs = append(alocs, locs...)
 
 		ii = jj
 	}
 
-	return alocs
-}
+	SortLocations(alocs)
 
-// argmax2 returns the indices of the two largest values in the array.
-// If the array has length 0 or 1, -1's are returned.
-func argmax2(x *[32]float64) (int, int) {
+	return alocs, nil
+}
 
-	if len(x) == 0 {
-		return -1, -1
-	}
-	if len(x) == 1 {
-		return 0, -1
-	}
+// SortLocations sorts locations by tag id and then by time, which is the order of the
+// records in all location files.  Locations with the same tag id and time are ordered
+// by site.
+func SortLocations(locs []*Location) {
 
-	j0, v0 := 0, x[0]
-	j1, v1 := 1, x[1]
-	if v1 > v0 {
-		j0, j1 = j1, j0
-		v0, v1 = v1, v0
-	}
-	for i := 2; i < len(x); i++ {
-		y := x[i]
-		if y > v0 {
-			j0, j1 = i, j0
-			v0, v1 = y, v0
-		} else if y > v1 {
-			j1 = i
-			v1 = y
+	sort.SliceStable(locs, func(i, j int) bool {
+		a, b := locs[i], locs[j]
+		if a.TagId != b.TagId {
+			return a.TagId < b.TagId
 		}
-	}
-
-	return j0, j1
+		if !a.TimeStamp.Equal(b.TimeStamp) {
+			return a.TimeStamp.Before(b.TimeStamp)
+		}
+		return a.Site < b.Site
+	})
 }
 
-// processMinute takes all the RFID records for a single minute and assigns a location
-// to each tag id for this minute.
-func processMinute(recs []*RFIDrecord) []*Location {
+// processWindow takes all the RFID records for a single time window and assigns a location
+// to each tag id for this window.  The number of rooms, nroom, includes the virtual
+// states, all room codes must be less than nroom.  Tags with no room having at least
+// opts.MinPings pings and a nonzero signal are not located.  The locations are in order
+// of tag id.
+func processWindow(recs []*RFIDrecord, nroom int, opts *LocationOptions) []*Location {
 
-	// 32 = max number of locations
-	signal := make(map[uint64]*[32]float64)
+	// The pings from each room, for each tag
+	pings := make(map[uint64][][]*RFIDrecord)
 
 	// Map from tag id values to an associated RFID record.  This is only used to get
 	// some static meta-data about each tag, so only one record is stored for each tag.
 	ctx := make(map[uint64]*RFIDrecord)
 
-	// Get the total signal for each tag within each room.
 	for _, x := range recs {
-		v, ok := signal[x.TagId]
+		p, ok := pings[x.TagId]
 		if !ok {
-			v = new([32]float64)
-			signal[x.TagId] = v
+			p = make([][]*RFIDrecord, nroom)
+			pings[x.TagId] = p
 		}
-
-		// Update signal
-		v[x.IP] += math.Exp(float64(x.Signal) / 10)
+		p[x.IP] = append(p[x.IP], x)
 
 		// Update ctx
 		ctx[x.TagId] = x
 	}
 
-	t0 := recs[0].TimeStamp.Truncate(twindow)
+	t0 := recs[0].TimeStamp.Truncate(opts.Window)
 
-	var locs []*Location
-	for tagid, v := range signal {
+	var window time.Duration
+	if opts.Window != time.Minute {
+		window = opts.Window
+	}
 
-		// The best and scond best match
-		j0, j1 := argmax2(v)
+	// Visit the tags in order, so that the result does not depend on the order of the map.
+	tagids := make([]uint64, 0, len(pings))
+	for tagid := range pings {
+		tagids = append(tagids, tagid)
+	}
+	sort.Slice(tagids, func(i, j int) bool { return tagids[i] < tagids[j] })
+
+	var locs []*Location
+	for _, tagid := range tagids {
+		p := pings[tagid]
+
+		// The rooms with a signal, ranked by signal
+		var rs []RoomSignal
+		var tot float64
+		for r, x := range p {
+			if len(x) > 0 && len(x) >= opts.MinPings {
+				if v := opts.signal(x); v > 0 {
+					rs = append(rs, RoomSignal{Room: RoomCode(r), Signal: v})
+					tot += v
+				}
+			}
+		}
+		if len(rs) == 0 {
+			continue
+		}
+		sort.SliceStable(rs, func(i, j int) bool { return rs[i].Signal > rs[j].Signal })
+		for i := range rs {
+			rs[i].Share = float32(rs[i].Signal / tot)
+		}
 
 		loc := &Location{
+			Site:        ctx[tagid].Site,
 			TagId:       tagid,
 			TimeStamp:   t0,
-			IP:          RoomCode(j0),
-			Signal:      v[j0],
+			Window:      window,
+			IP:          rs[0].Room,
+			Signal:      rs[0].Signal,
 			CSN:         ctx[tagid].CSN,
 			IP2:         Null,
 			PersonCat:   ctx[tagid].PersonCat,
@@ -154,10 +244,16 @@ func processMinute(recs []*RFIDrecord) []*Location {
 		}
 
 		// If there is a second-best match, include it too
-		if j1 != -1 {
-			loc.IP2 = RoomCode(j1)
-			loc.Signal2 = v[j1]
+		if len(rs) > 1 {
+			loc.IP2 = rs[1].Room
+			loc.Signal2 = rs[1].Signal
 		}
+
+		if opts.TopK > 0 && len(rs) > opts.TopK {
+			rs = rs[0:opts.TopK]
+		}
+		loc.Signals = rs
+
 		locs = append(locs, loc)
 	}
 
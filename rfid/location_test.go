@@ -0,0 +1,226 @@
+package rfid
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestProcessMinute(t *testing.T) {
+
+	nroom := 200
+	t0 := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	recs := []*RFIDrecord{
+		{TagId: 1, IP: 150, Signal: -60, TimeStamp: t0},
+		{TagId: 1, IP: 150, Signal: -62, TimeStamp: t0.Add(10 * time.Second)},
+		{TagId: 1, IP: 199, Signal: -50, TimeStamp: t0.Add(20 * time.Second)},
+		{TagId: 1, IP: 5, Signal: -80, TimeStamp: t0.Add(30 * time.Second)},
+	}
+
+	locs := processWindow(recs, nroom, DefaultLocationOptions())
+	if len(locs) != 1 {
+		t.Fatalf("expected one location, got %d", len(locs))
+	}
+
+	loc := locs[0]
+	if loc.IP != 199 || loc.IP2 != 150 {
+		t.Errorf("got rooms %d and %d, expected 199 and 150", loc.IP, loc.IP2)
+	}
+	if !loc.TimeStamp.Equal(t0) {
+		t.Fail()
+	}
+
+	// Ranked by signal
+	if len(loc.Signals) != 3 || loc.Signals[0].Room != 199 || loc.Signals[1].Room != 150 || loc.Signals[2].Room != 5 {
+		t.Errorf("unexpected room signals %v", loc.Signals)
+	}
+	if loc.Signals[0].Signal != loc.Signal || loc.Signals[1].Signal != loc.Signal2 {
+		t.Errorf("room signals %v don't agree with the top two signals", loc.Signals)
+	}
+	var tot float64
+	for _, rs := range loc.Signals {
+		tot += float64(rs.Share)
+	}
+	if math.Abs(tot-1) > 1e-6 || loc.Signals[0].Share <= loc.Signals[1].Share {
+		t.Errorf("unexpected shares %v", loc.Signals)
+	}
+
+	// Only the top rooms are kept, with the shares of the full signal
+	opts := DefaultLocationOptions()
+	opts.TopK = 2
+	loc2 := processWindow(recs, nroom, opts)[0]
+	if len(loc2.Signals) != 2 || loc2.Signals[1] != loc.Signals[1] {
+		t.Errorf("unexpected top two room signals %v", loc2.Signals)
+	}
+
+	// A tag seen by only one reader has no second room
+	loc = processWindow(recs[3:], nroom, DefaultLocationOptions())[0]
+	if loc.IP != 5 || loc.IP2 != Null || loc.Signal2 != 0 {
+		t.Errorf("got rooms %d and %d with one reader, expected 5 and Null", loc.IP, loc.IP2)
+	}
+	if len(loc.Signals) != 1 || loc.Signals[0].Share != 1 {
+		t.Errorf("unexpected room signals %v", loc.Signals)
+	}
+}
+
+func TestSetPosterior(t *testing.T) {
+
+	loc := new(Location)
+	loc.SetPosterior(2, []float64{0.1, 0.3, 0.6, 0})
+
+	if loc.IPhmm != 2 || loc.PostHMM != 0.6 {
+		t.Errorf("got room %d with probability %f, expected 2 with 0.6", loc.IPhmm, loc.PostHMM)
+	}
+	if loc.IPhmm2 != 1 || loc.PostHMM2 != 0.3 {
+		t.Errorf("got runner-up %d with probability %f, expected 1 with 0.3", loc.IPhmm2, loc.PostHMM2)
+	}
+
+	ent := -(0.1*math.Log(0.1) + 0.3*math.Log(0.3) + 0.6*math.Log(0.6))
+	if math.Abs(loc.EntropyHMM-ent) > 1e-12 {
+		t.Errorf("got entropy %f, expected %f", loc.EntropyHMM, ent)
+	}
+
+	// The predicted room need not have the highest posterior probability.
+	loc.SetPosterior(0, []float64{0.1, 0.3, 0.6, 0})
+	if loc.IPhmm2 != 2 || loc.PostHMM2 != 0.6 {
+		t.Errorf("got runner-up %d with probability %f, expected 2 with 0.6", loc.IPhmm2, loc.PostHMM2)
+	}
+
+	// No runner-up when the location is certain.
+	loc.SetPosterior(1, []float64{0, 1, 0, 0})
+	if loc.IPhmm2 != Null || loc.EntropyHMM != 0 {
+		t.Errorf("got runner-up %d and entropy %f for a certain location", loc.IPhmm2, loc.EntropyHMM)
+	}
+}
+
+func TestLocationOptions(t *testing.T) {
+
+	nroom := 10
+	t0 := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	// Room 5 has many weak pings, room 6 has one strong ping
+	recs := []*RFIDrecord{
+		{TagId: 1, IP: 5, Signal: -70, Reads: 3, TimeStamp: t0},
+		{TagId: 1, IP: 5, Signal: -71, Reads: 3, TimeStamp: t0.Add(10 * time.Second)},
+		{TagId: 1, IP: 5, Signal: -72, Reads: 3, TimeStamp: t0.Add(20 * time.Second)},
+		{TagId: 1, IP: 5, Signal: -40, Reads: 3, TimeStamp: t0.Add(25 * time.Second)},
+		{TagId: 1, IP: 6, Signal: -50, Reads: 1, TimeStamp: t0.Add(30 * time.Second)},
+		{TagId: 2, IP: 7, Signal: -60, Reads: 1, TimeStamp: t0.Add(40 * time.Second)},
+	}
+
+	for _, c := range []struct {
+		weighting Weighting
+		minPings  int
+		room      RoomCode
+		signal    float64
+	}{
+		{ExpWeight, 1, 5, math.Exp(-7) + math.Exp(-7.1) + math.Exp(-7.2) + math.Exp(-4)},
+		{LinearWeight, 1, 5, 50 + 49 + 48 + 80},
+		{MaxWeight, 1, 5, math.Exp(-4)},
+		{ReadsWeight, 1, 5, 3 * (math.Exp(-7) + math.Exp(-7.1) + math.Exp(-7.2) + math.Exp(-4))},
+		{TrimmedMeanWeight, 1, 6, math.Exp(-5)},
+		{MaxWeight, 2, 5, math.Exp(-4)},
+	} {
+		opts := DefaultLocationOptions()
+		opts.Weighting = c.weighting
+		opts.MinPings = c.minPings
+		opts.Trim = 0.25
+
+		recx := recs
+		if c.minPings > 1 {
+			// Tag 2 has too few pings to be located
+			recx = recs[0:5]
+		}
+		locs, err := GetLocation(recx, &SiteConfig{Rooms: make([]*Room, nroom)}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var loc *Location
+		for _, l := range locs {
+			if l.TagId == 1 {
+				loc = l
+			}
+		}
+		if loc == nil {
+			t.Fatalf("%v: tag 1 not located", c.weighting)
+		}
+		if loc.IP != c.room || math.Abs(loc.Signal-c.signal) > 1e-12 {
+			t.Errorf("%v: got room %d with signal %f, expected room %d with %f", c.weighting, loc.IP, loc.Signal, c.room, c.signal)
+		}
+		if c.minPings > 1 && len(loc.Signals) != 1 {
+			t.Errorf("room with too few pings was used")
+		}
+	}
+
+	// Tags with too few pings in every room are not located
+	opts := DefaultLocationOptions()
+	opts.MinPings = 2
+	for _, loc := range processWindow(recs, nroom, opts) {
+		if loc.TagId == 2 {
+			t.Errorf("tag with one ping was located")
+		}
+	}
+
+	// Shorter windows
+	opts = DefaultLocationOptions()
+	opts.Window = 15 * time.Second
+	locs, err := GetLocation(recs, &SiteConfig{Rooms: make([]*Room, nroom)}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 4 {
+		t.Errorf("got %d locations in 15 second windows, expected 4", len(locs))
+	}
+	for _, loc := range locs {
+		if loc.WindowLength() != 15*time.Second || loc.TimeStamp.Sub(t0)%(15*time.Second) != 0 {
+			t.Errorf("location has window %v starting at %v", loc.WindowLength(), loc.TimeStamp)
+		}
+	}
+
+	for _, w := range []time.Duration{0, 7 * time.Second, 90 * time.Second} {
+		opts.Window = w
+		if opts.Check() == nil {
+			t.Errorf("window %v should be rejected", w)
+		}
+	}
+
+	// Invalid options are reported, not used
+	opts = DefaultLocationOptions()
+	opts.Weighting = Weighting(99)
+	if _, err := GetLocation(recs, &SiteConfig{Rooms: make([]*Room, nroom)}, opts); err == nil {
+		t.Errorf("unknown weighting was accepted")
+	}
+}
+
+// Locations are sorted by tag id and then by time, whatever the order of the tags
+// in the raw data.
+func TestGetLocationOrder(t *testing.T) {
+
+	t0 := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	var recs []*RFIDrecord
+	for m := 0; m < 3; m++ {
+		for _, tag := range []uint64{9, 3, 7, 1, 5} {
+			tm := t0.Add(time.Duration(m)*time.Minute + time.Duration(tag)*time.Second)
+			recs = append(recs, &RFIDrecord{TagId: tag, IP: 5, Signal: -60, TimeStamp: tm})
+		}
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].TimeStamp.Before(recs[j].TimeStamp) })
+
+	locs, err := GetLocation(recs, &SiteConfig{Rooms: make([]*Room, 10)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 15 {
+		t.Fatalf("got %d locations, expected 15", len(locs))
+	}
+	for i := 1; i < len(locs); i++ {
+		a, b := locs[i-1], locs[i]
+		if a.TagId > b.TagId || (a.TagId == b.TagId && !a.TimeStamp.Before(b.TimeStamp)) {
+			t.Errorf("locations %d and %d are out of order", i-1, i)
+		}
+	}
+}
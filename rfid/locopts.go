@@ -0,0 +1,158 @@
+package rfid
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Weighting determines how the signals of the pings for a tag from one room during
+// one time window are combined into a signal for the room.
+type Weighting uint8
+
+// The ways of combining the signals.  Signals are in dBm, so exp(signal/10) is
+// proportional to the received power.
+const (
+	// Sum of exp(signal/10) over the pings
+	ExpWeight Weighting = iota
+
+	// Sum of the signal above linearFloor over the pings
+	LinearWeight
+
+	// exp(signal/10) for the strongest ping
+	MaxWeight
+
+	// Sum of exp(signal/10) over the pings, weighted by the number of reads
+	// of each ping (at least 1)
+	ReadsWeight
+
+	// exp(m/10), where m is the trimmed mean of the signals
+	TrimmedMeanWeight
+)
+
+// linearFloor is the signal (in dBm) that contributes zero with LinearWeight.
+const linearFloor = -120
+
+var (
+	// weightingNames maps the weighting codes to their text labels.
+	weightingNames = map[Weighting]string{
+		ExpWeight:         "exp",
+		LinearWeight:      "linear",
+		MaxWeight:         "max",
+		ReadsWeight:       "reads",
+		TrimmedMeanWeight: "trimmed",
+	}
+)
+
+// String returns the text label of a weighting.
+func (w Weighting) String() string {
+	return weightingNames[w]
+}
+
+// ParseWeighting returns the weighting with the given text label.
+func ParseWeighting(s string) (Weighting, error) {
+
+	for k, v := range weightingNames {
+		if v == s {
+			return k, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown weighting '%s'", s)
+}
+
+// LocationOptions controls how GetLocation combines pings into locations.
+type LocationOptions struct {
+
+	// The pings are aggregated over time windows of this length
+	Window time.Duration
+
+	// How the signals from one room are combined
+	Weighting Weighting
+
+	// Rooms with fewer pings than this for a tag during a window are ignored
+	MinPings int
+
+	// The fraction of the signals removed from each end for TrimmedMeanWeight
+	Trim float64
+
+	// The number of ranked rooms kept in Location.Signals, 0 to keep all rooms
+	// with a signal
+	TopK int
+}
+
+// DefaultLocationOptions returns the standard options, one minute windows with
+// exponential weights, no minimum number of pings, and all rooms
+// with a signal kept.
+func DefaultLocationOptions() *LocationOptions {
+	return &LocationOptions{
+		Window:    time.Minute,
+		Weighting: ExpWeight,
+		MinPings:  1,
+		Trim:      0.1,
+	}
+}
+
+// Check returns an error if the options are invalid.
+func (opts *LocationOptions) Check() error {
+
+	switch {
+	case weightingNames[opts.Weighting] == "":
+		return fmt.Errorf("unknown weighting %d", opts.Weighting)
+	case opts.Window < time.Second:
+		return fmt.Errorf("window %v is shorter than one second", opts.Window)
+	case time.Minute%opts.Window != 0 && opts.Window%time.Minute != 0:
+		return fmt.Errorf("window %v must divide or be a multiple of one minute", opts.Window)
+	case opts.Trim < 0 || opts.Trim >= 0.5:
+		return fmt.Errorf("trim fraction %v must be in [0, 0.5)", opts.Trim)
+	case opts.TopK < 0:
+		return fmt.Errorf("number of ranked rooms %d is negative", opts.TopK)
+	}
+
+	return nil
+}
+
+// signal returns the combined signal for the pings from one room.  The weighting
+// must have been checked by Check.
+func (opts *LocationOptions) signal(pings []*RFIDrecord) float64 {
+
+	var v float64
+
+	switch opts.Weighting {
+	case ExpWeight:
+		for _, x := range pings {
+			v += math.Exp(float64(x.Signal) / 10)
+		}
+	case LinearWeight:
+		for _, x := range pings {
+			v += math.Max(float64(x.Signal)-linearFloor, 0)
+		}
+	case MaxWeight:
+		m := math.Inf(-1)
+		for _, x := range pings {
+			m = math.Max(m, float64(x.Signal))
+		}
+		v = math.Exp(m / 10)
+	case ReadsWeight:
+		for _, x := range pings {
+			r := math.Max(float64(x.Reads), 1)
+			v += r * math.Exp(float64(x.Signal)/10)
+		}
+	case TrimmedMeanWeight:
+		s := make([]float64, len(pings))
+		for i, x := range pings {
+			s[i] = float64(x.Signal)
+		}
+		sort.Float64s(s)
+		k := int(opts.Trim * float64(len(s)))
+		s = s[k : len(s)-k]
+		var m float64
+		for _, y := range s {
+			m += y
+		}
+		v = math.Exp(m / float64(len(s)) / 10)
+	}
+
+	return v
+}
@@ -2,6 +2,7 @@ package rfid
 
 import (
 	"fmt"
+	"math"
 
 	"gonum.org/v1/gonum/floats"
 )
@@ -15,18 +16,31 @@ type HMM struct {
 	// The emission probabilities
 	emis [][]float64
 
+	// The likelihood of the observation at each time point for each state,
+	// used in place of data and emis if set
+	lik [][]float64
+
 	// The marginal distribution of the first point
 	start []float64
 
 	// The transition probabilities
 	trans [][]float64
 
+	// The transition probabilities, used in place of trans if set
+	strans *SparseTrans
+
 	// The forward probabilites
 	fprob [][]float64
 
 	// The backward probabilites
 	bprob [][]float64
 
+	// The scale factors for the forward and backward probabilities
+	scale []float64
+
+	// The log-likelihood of the data
+	LogLik float64
+
 	// Posterior probabilities
 	PostProb [][]float64
 
@@ -62,31 +76,76 @@ func alloci(row, col int) [][]int {
 	return x
 }
 
-func probnorm(probs []float64) {
-	mx := floats.Max(probs)
-	floats.Scale(1/mx, probs)
+// emission returns the probability of the observation at time t in state j.
+func (hmm *HMM) emission(t, j int) float64 {
+
+	if hmm.lik != nil {
+		return hmm.lik[t][j]
+	}
+
+	return hmm.emis[j][hmm.data[t]]
 }
 
-// forward calculates the forward HMM probabilities.
-func (hmm *HMM) forward() {
+// rescale scales the forward probabilities at time t to sum to 1, and
+// retains the scale factor.
+func (hmm *HMM) rescale(t int) error {
+
+	c := floats.Sum(hmm.fprob[t])
+	if c == 0 || math.IsNaN(c) {
+		return fmt.Errorf("%w: all states have zero probability at time %d", ErrDegenerateHMM, t)
+	}
+
+	floats.Scale(1/c, hmm.fprob[t])
+	hmm.scale[t] = c
+
+	return nil
+}
+
+// forward calculates the forward HMM probabilities.  The probabilities at each
+// time point are scaled to sum to 1, so they do not underflow for long sequences.
+// The scale factors give the log-likelihood of the data, and are also used to
+// scale the backward probabilities.
+func (hmm *HMM) forward() error {
 
 	for j := 0; j < hmm.nState; j++ {
-		hmm.fprob[0][j] = hmm.start[j] * hmm.emis[j][hmm.data[0]]
+		hmm.fprob[0][j] = hmm.start[j] * hmm.emission(0, j)
+	}
+	if err := hmm.rescale(0); err != nil {
+		return err
 	}
 
 	for t := 1; t < hmm.nTime; t++ {
 		for j := 0; j < hmm.nState; j++ {
-			f := hmm.emis[j][hmm.data[t]]
+			f := hmm.emission(t, j)
+			if f == 0 {
+				continue
+			}
+			if hmm.strans != nil {
+				for _, e := range hmm.strans.in[j] {
+					hmm.fprob[t][j] += f * hmm.fprob[t-1][e.state] * e.prob
+				}
+				continue
+			}
 			for k := 0; k < hmm.nState; k++ {
 				hmm.fprob[t][j] += f * hmm.fprob[t-1][k] * hmm.trans[k][j]
 			}
 		}
 
-		probnorm(hmm.fprob[t])
+		if err := hmm.rescale(t); err != nil {
+			return err
+		}
 	}
+
+	hmm.LogLik = 0
+	for _, c := range hmm.scale {
+		hmm.LogLik += math.Log(c)
+	}
+
+	return nil
 }
 
-// backward calculates the backward HMM probabilities.
+// backward calculates the backward HMM probabilities, scaled using the
+// scale factors from the forward pass.
 func (hmm *HMM) backward() {
 
 	for j := 0; j < hmm.nState; j++ {
@@ -95,18 +154,24 @@ func (hmm *HMM) backward() {
 
 	for t := hmm.nTime - 2; t >= 0; t-- {
 		for j := 0; j < hmm.nState; j++ {
+			if hmm.strans != nil {
+				for _, e := range hmm.strans.out[j] {
+					hmm.bprob[t][j] += hmm.bprob[t+1][e.state] * e.prob * hmm.emission(t+1, e.state)
+				}
+				continue
+			}
 			for k := 0; k < hmm.nState; k++ {
-				hmm.bprob[t][j] += hmm.bprob[t+1][k] * hmm.trans[j][k] * hmm.emis[k][hmm.data[t+1]]
+				hmm.bprob[t][j] += hmm.bprob[t+1][k] * hmm.trans[j][k] * hmm.emission(t+1, k)
 			}
 		}
 
-		probnorm(hmm.bprob[t])
+		floats.Scale(1/hmm.scale[t+1], hmm.bprob[t])
 	}
 }
 
 // getPost calculates the conditional probabilities of the state sequence
 // given the data.
-func (hmm *HMM) getPost() {
+func (hmm *HMM) getPost() error {
 
 	hmm.PostProb = alloc(hmm.nTime, hmm.nState)
 
@@ -115,45 +180,78 @@ func (hmm *HMM) getPost() {
 		for j := 0; j < hmm.nState; j++ {
 			d += hmm.fprob[t][j] * hmm.bprob[t][j]
 		}
-		if d == 0 {
-			fmt.Printf("%v\n", hmm.fprob[t])
-			fmt.Printf("%v\n", hmm.bprob[t])
-			panic("ZERO\n")
+		if d == 0 || math.IsNaN(d) {
+			return fmt.Errorf("%w: all states have zero probability at time %d", ErrDegenerateHMM, t)
 		}
 		for j := 0; j < hmm.nState; j++ {
 			hmm.PostProb[t][j] = hmm.fprob[t][j] * hmm.bprob[t][j] / d
 		}
 	}
+
+	return nil
+}
+
+// logs returns the elementwise logarithms of a matrix.
+func logs(x [][]float64) [][]float64 {
+
+	y := alloc(len(x), len(x[0]))
+	for i := range x {
+		for j := range x[i] {
+			y[i][j] = math.Log(x[i][j])
+		}
+	}
+
+	return y
 }
 
+// viterbi calculates the most likely state sequence, working with log
+// probabilities so that long sequences do not underflow.
 func (hmm *HMM) viterbi() {
 
 	vp := alloc(hmm.nTime, hmm.nState)
 	vl := alloci(hmm.nTime, hmm.nState)
 
+	// The log transition probabilities into each state
+	var lin [][]edge
+	if hmm.strans != nil {
+		lin = make([][]edge, hmm.nState)
+		for j, in := range hmm.strans.in {
+			for _, e := range in {
+				lin[j] = append(lin[j], edge{e.state, math.Log(e.prob)})
+			}
+		}
+	} else {
+		ltrans := logs(hmm.trans)
+		lin = make([][]edge, hmm.nState)
+		for j := range lin {
+			for k := 0; k < hmm.nState; k++ {
+				lin[j] = append(lin[j], edge{k, ltrans[k][j]})
+			}
+		}
+	}
+
 	for j := 0; j < hmm.nState; j++ {
-		vp[0][j] = hmm.start[j] * hmm.emis[j][hmm.data[0]]
+		vp[0][j] = math.Log(hmm.start[j]) + math.Log(hmm.emission(0, j))
 	}
 
 	for t := 1; t < hmm.nTime; t++ {
 		for j := 0; j < hmm.nState; j++ {
 
-			q := vp[t-1][0] * hmm.trans[0][j] * hmm.emis[j][hmm.data[t]]
+			e := math.Log(hmm.emission(t, j))
+			q := math.Inf(-1)
 			l := 0
 
-			for k := 1; k < hmm.nState; k++ {
-				qq := vp[t-1][k] * hmm.trans[k][j] * hmm.emis[j][hmm.data[t]]
-				if qq > q {
+			for i, ed := range lin[j] {
+				qq := vp[t-1][ed.state] + ed.prob + e
+				if i == 0 || qq > q {
 					q = qq
-					l = k
+					l = ed.state
 				}
 			}
 
 			vp[t][j] = q
 			vl[t][j] = l
 		}
-
-		probnorm(vp[t])
 	}
 
 	hmm.Pred = make([]int, hmm.nTime)
@@ -176,16 +274,49 @@ func (hmm *HMM) viterbi() {
 	}
 }
 
+// Emission returns the emission probabilities.
+func (hmm *HMM) Emission() [][]float64 {
+	return hmm.emis
+}
+
+// Transmission returns the transmission probability matrix.
+func (hmm *HMM) Transmission() [][]float64 {
+
+	if hmm.strans != nil {
+		return hmm.strans.Dense()
+	}
+
+	return hmm.trans
+}
+
+// Start returns the starting probability distribution.
+func (hmm *HMM) Start() []float64 {
+	return hmm.start
+}
+
 // SetEmission sets tbe emission probabilities.
 func (hmm *HMM) SetEmission(emis [][]float64) {
 	hmm.emis = emis
 }
 
+// SetLikelihood sets the likelihood of the observation at each time point for each
+// state, lik[t][j] for time t and state j.  This is used in place of the data and
+// emission probabilities, for observations that are not a single discrete value.
+func (hmm *HMM) SetLikelihood(lik [][]float64) {
+	hmm.lik = lik
+}
+
 // SetTransmission sets the transmission probability matrix.
 func (hmm *HMM) SetTransmission(trans [][]float64) {
 	hmm.trans = trans
 }
 
+// SetSparseTransmission sets the transmission probabilities using a sparse
+// representation, which is used in place of any matrix set with SetTransmission.
+func (hmm *HMM) SetSparseTransmission(st *SparseTrans) {
+	hmm.strans = st
+}
+
 // SetData sets the data to which the HMM will be fit.
 func (hmm *HMM) SetData(data []int) {
 	hmm.data = data
@@ -196,17 +327,36 @@ func (hmm *HMM) SetStart(start []float64) {
 	hmm.start = start
 }
 
-// Fit calculates the posterior probabilities of the HMM based on the data.
-func (hmm *HMM) Fit() {
+// Fit calculates the posterior probabilities of the HMM based on the data.  An
+// error wrapping ErrDegenerateHMM is returned if the data have zero probability
+// under the model.
+func (hmm *HMM) Fit() error {
 
 	hmm.nTime = len(hmm.data)
-	hmm.nState = len(hmm.emis)
+	if hmm.lik != nil {
+		hmm.nTime = len(hmm.lik)
+	}
+	hmm.nState = len(hmm.trans)
+	if hmm.strans != nil {
+		hmm.nState = hmm.strans.n
+	}
+
+	if hmm.nTime == 0 {
+		return fmt.Errorf("HMM has no data")
+	}
 
 	hmm.fprob = alloc(hmm.nTime, hmm.nState)
 	hmm.bprob = alloc(hmm.nTime, hmm.nState)
+	hmm.scale = make([]float64, hmm.nTime)
 
-	hmm.forward()
+	if err := hmm.forward(); err != nil {
+		return err
+	}
 	hmm.backward()
-	hmm.getPost()
+	if err := hmm.getPost(); err != nil {
+		return err
+	}
 	hmm.viterbi()
+
+	return nil
 }
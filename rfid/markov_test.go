@@ -1,8 +1,12 @@
 package rfid
 
 import (
+	"errors"
 	"math"
+	"math/rand"
 	"testing"
+
+	"gonum.org/v1/gonum/floats"
 )
 
 /*
@@ -64,7 +68,9 @@ func TestMarkov(t *testing.T) {
 		hmm.SetTransmission(q.trans)
 		hmm.SetData(q.data)
 		hmm.SetStart(q.start)
-		hmm.Fit()
+		if err := hmm.Fit(); err != nil {
+			t.Fatal(err)
+		}
 
 		for i := 0; i < len(q.data); i++ {
 			for j := 0; j < len(q.start); j++ {
@@ -79,5 +85,277 @@ func TestMarkov(t *testing.T) {
 				t.Fail()
 			}
 		}
+
+		if math.Abs(hmm.LogLik-bruteLogLik(q.emis, q.trans, q.start, q.data)) > 1e-10 {
+			t.Errorf("log-likelihood %f, expected %f", hmm.LogLik, bruteLogLik(q.emis, q.trans, q.start, q.data))
+		}
+	}
+}
+
+// bruteLogLik calculates the log-likelihood of a short sequence by summing
+// over all possible state sequences.
+func bruteLogLik(emis, trans [][]float64, start []float64, data []int) float64 {
+
+	ns := len(start)
+	path := make([]int, len(data))
+	var total float64
+
+	for {
+		p := start[path[0]] * emis[path[0]][data[0]]
+		for t := 1; t < len(data); t++ {
+			p *= trans[path[t-1]][path[t]] * emis[path[t]][data[t]]
+		}
+		total += p
+
+		// Advance to the next state sequence
+		i := 0
+		for ; i < len(path); i++ {
+			path[i]++
+			if path[i] < ns {
+				break
+			}
+			path[i] = 0
+		}
+		if i == len(path) {
+			break
+		}
+	}
+
+	return math.Log(total)
+}
+
+// pathLogProb returns the joint log probability of a state sequence and the data.
+func pathLogProb(emis, trans [][]float64, start []float64, data, path []int) float64 {
+
+	lp := math.Log(start[path[0]]) + math.Log(emis[path[0]][data[0]])
+	for t := 1; t < len(data); t++ {
+		lp += math.Log(trans[path[t-1]][path[t]]) + math.Log(emis[path[t]][data[t]])
+	}
+
+	return lp
+}
+
+// Long sequences with structural zeros in the transitions and emissions, which
+// underflow unless the probabilities are scaled.
+func TestMarkovLong(t *testing.T) {
+
+	emis := [][]float64{
+		[]float64{0.7, 0.2, 0.1, 0},
+		[]float64{0.1, 0.7, 0.1, 0.1},
+		[]float64{0, 0.1, 0.8, 0.1},
+	}
+	trans := [][]float64{
+		[]float64{0.95, 0.05, 0},
+		[]float64{0.02, 0.95, 0.03},
+		[]float64{0, 0, 1},
+	}
+	start := []float64{0.8, 0.2, 0}
+
+	for _, n := range []int{1000, 5000, 20000} {
+
+		// Simulate a state sequence and data
+		rng := rand.New(rand.NewSource(int64(n)))
+		draw := func(p []float64) int {
+			u := rng.Float64()
+			for j, q := range p {
+				if u < q {
+					return j
+				}
+				u -= q
+			}
+			return len(p) - 1
+		}
+		states := make([]int, n)
+		data := make([]int, n)
+		states[0] = draw(start)
+		data[0] = draw(emis[states[0]])
+		for i := 1; i < n; i++ {
+			states[i] = draw(trans[states[i-1]])
+			data[i] = draw(emis[states[i]])
+		}
+
+		hmm := HMM{}
+		hmm.SetEmission(emis)
+		hmm.SetTransmission(trans)
+		hmm.SetData(data)
+		hmm.SetStart(start)
+		if err := hmm.Fit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if math.IsInf(hmm.LogLik, 0) || math.IsNaN(hmm.LogLik) || hmm.LogLik > 0 {
+			t.Errorf("n=%d: invalid log-likelihood %f", n, hmm.LogLik)
+		}
+
+		for i := range hmm.PostProb {
+			var tot float64
+			for _, p := range hmm.PostProb[i] {
+				tot += p
+			}
+			if math.Abs(tot-1) > 1e-8 {
+				t.Errorf("n=%d: posterior probabilities sum to %f at time %d", n, tot, i)
+				break
+			}
+		}
+
+		// The Viterbi path must be possible, and at least as likely as the true path.
+		vlp := pathLogProb(emis, trans, start, data, hmm.Pred)
+		tlp := pathLogProb(emis, trans, start, data, states)
+		if math.IsInf(vlp, -1) || vlp < tlp {
+			t.Errorf("n=%d: Viterbi path log probability %f, true path %f", n, vlp, tlp)
+		}
+
+		// The Viterbi path is bounded by the log-likelihood
+		if vlp > hmm.LogLik {
+			t.Errorf("n=%d: Viterbi path log probability %f exceeds log-likelihood %f", n, vlp, hmm.LogLik)
+		}
+	}
+}
+
+// The data have zero probability if a state can't emit its observation.
+func TestMarkovDegenerate(t *testing.T) {
+
+	hmm := HMM{}
+	hmm.SetEmission([][]float64{[]float64{1, 0}, []float64{1, 0}})
+	hmm.SetTransmission([][]float64{[]float64{0.5, 0.5}, []float64{0.5, 0.5}})
+	hmm.SetData([]int{0, 1, 0})
+	hmm.SetStart([]float64{0.5, 0.5})
+
+	if err := hmm.Fit(); !errors.Is(err, ErrDegenerateHMM) {
+		t.Errorf("expected ErrDegenerateHMM, got %v", err)
+	}
+}
+
+// randomSparse returns a random transition matrix in which each state can
+// move to itself and to nbr other states.
+func randomSparse(rng *rand.Rand, nstate, nbr int) [][]float64 {
+
+	trans := alloc(nstate, nstate)
+	for j := range trans {
+		trans[j][j] = 10
+		for i := 0; i < nbr; i++ {
+			trans[j][rng.Intn(nstate)] += rng.Float64()
+		}
+		floats.Scale(1/floats.Sum(trans[j]), trans[j])
+	}
+
+	return trans
+}
+
+// randomEmission returns a random emission matrix favoring the observation
+// that matches the state.
+func randomEmission(rng *rand.Rand, nstate int) [][]float64 {
+
+	emis := alloc(nstate, nstate)
+	for j := range emis {
+		for k := range emis[j] {
+			emis[j][k] = rng.Float64()
+		}
+		emis[j][j] = float64(nstate)
+		floats.Scale(1/floats.Sum(emis[j]), emis[j])
+	}
+
+	return emis
+}
+
+func TestMarkovSparse(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(3))
+	nstate := 40
+
+	trans := randomSparse(rng, nstate, 3)
+	emis := randomEmission(rng, nstate)
+	start := make([]float64, nstate)
+	for j := range start {
+		start[j] = 1 / float64(nstate)
+	}
+	_, data := simulate(rng, emis, trans, start, 500)
+
+	dense := &HMM{}
+	dense.SetEmission(emis)
+	dense.SetTransmission(trans)
+	dense.SetStart(start)
+	dense.SetData(data)
+	if err := dense.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := NewSparseTrans(trans)
+	if st.NumEdges() > 4*nstate {
+		t.Errorf("sparse matrix has %d transitions, expected at most %d", st.NumEdges(), 4*nstate)
+	}
+
+	sparse := &HMM{}
+	sparse.SetEmission(emis)
+	sparse.SetSparseTransmission(st)
+	sparse.SetStart(start)
+	sparse.SetData(data)
+	if err := sparse.Fit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(dense.LogLik-sparse.LogLik) > 1e-8 {
+		t.Errorf("log-likelihoods differ: %f %f", dense.LogLik, sparse.LogLik)
+	}
+	for i := range data {
+		if dense.Pred[i] != sparse.Pred[i] {
+			t.Errorf("predictions differ at %d", i)
+		}
+		for j := 0; j < nstate; j++ {
+			if math.Abs(dense.PostProb[i][j]-sparse.PostProb[i][j]) > 1e-8 {
+				t.Errorf("posterior probabilities differ at %d, %d", i, j)
+			}
+		}
+	}
+
+	for j := range trans {
+		for k := range trans[j] {
+			if sparse.Transmission()[j][k] != trans[j][k] {
+				t.Errorf("dense version of sparse matrix differs at %d, %d", j, k)
+			}
+		}
 	}
 }
+
+// Compare the dense and sparse transition matrices for a large site, with 300
+// rooms each connected to a few others, and a day of minutes.
+func BenchmarkMarkov(b *testing.B) {
+
+	rng := rand.New(rand.NewSource(4))
+	nstate := 300
+
+	trans := randomSparse(rng, nstate, 4)
+	emis := randomEmission(rng, nstate)
+	start := make([]float64, nstate)
+	for j := range start {
+		start[j] = 1 / float64(nstate)
+	}
+	_, data := simulate(rng, emis, trans, start, 600)
+
+	b.Run("dense", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			hmm := &HMM{}
+			hmm.SetEmission(emis)
+			hmm.SetTransmission(trans)
+			hmm.SetStart(start)
+			hmm.SetData(data)
+			if err := hmm.Fit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("sparse", func(b *testing.B) {
+		st := NewSparseTrans(trans)
+		for i := 0; i < b.N; i++ {
+			hmm := &HMM{}
+			hmm.SetEmission(emis)
+			hmm.SetSparseTransmission(st)
+			hmm.SetStart(start)
+			hmm.SetData(data)
+			if err := hmm.Fit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package rfid
+
+import (
+	"time"
+)
+
+// presenceKey identifies one time window at one site.
+type presenceKey struct {
+	site string
+	t    int64
+}
+
+// Presence accumulates, for each site and time window, the probability that at least
+// one person is in each room, based on the posterior location probabilities of individual
+// people, which are treated as independent.  Times are the starts of the time windows,
+// as in Location.TimeStamp.
+type Presence struct {
+
+	// The probability that no one is in each room
+	absent map[presenceKey][]float64
+}
+
+// NewPresence returns a Presence value with no people.
+func NewPresence() *Presence {
+	return &Presence{absent: make(map[presenceKey][]float64)}
+}
+
+// Add includes one person at the given site and time, with posterior location
+// probabilities post.
+func (pr *Presence) Add(site string, t time.Time, post []float64) {
+
+	key := presenceKey{site, t.Unix()}
+	a, ok := pr.absent[key]
+	if !ok {
+		a = make([]float64, len(post))
+		for j := range a {
+			a[j] = 1
+		}
+		pr.absent[key] = a
+	}
+
+	for j, p := range post {
+		a[j] *= 1 - p
+	}
+}
+
+// Prob returns the probability that at least one person is in each room at the
+// given site and time, or nil if no one was added for that time.
+func (pr *Presence) Prob(site string, t time.Time) []float64 {
+
+	a, ok := pr.absent[presenceKey{site, t.Unix()}]
+	if !ok {
+		return nil
+	}
+
+	p := make([]float64, len(a))
+	for j := range a {
+		p[j] = 1 - a[j]
+	}
+
+	return p
+}
+
+// Boost multiplies the likelihood lik[t][j] of each physical room j for the location
+// locs[t] by 1 + weight*p, where p is the probability that someone is in room j at
+// the same site and time.  Virtual states are not changed, since being in them at
+// the same time says nothing about being together.
+func (pr *Presence) Boost(lik [][]float64, locs []*Location, weight float64, site *SiteConfig) {
+
+	for t, loc := range locs {
+		p := pr.Prob(loc.Site, loc.TimeStamp)
+		if p == nil {
+			continue
+		}
+		for j := range lik[t] {
+			if site.Room(RoomCode(j)).Category != VirtualRoom {
+				lik[t][j] *= 1 + weight*p[j]
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package rfid
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nroom := site.NumRooms()
+	exam1 := site.RoomByName("Exam1")
+
+	t0 := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	// Two providers who may be in Exam1, or are in NoSignal
+	pr := NewPresence()
+	for _, p := range []float64{0.5, 0.8} {
+		post := make([]float64, nroom)
+		post[exam1.Code] = p
+		post[NoSignal] = 1 - p
+		pr.Add(site.Name, t0, post)
+	}
+
+	prob := pr.Prob(site.Name, t0)
+	if math.Abs(prob[exam1.Code]-0.9) > 1e-12 {
+		t.Errorf("got presence %f in Exam1, expected 0.9", prob[exam1.Code])
+	}
+	if pr.Prob(site.Name, t0.Add(time.Minute)) != nil || pr.Prob("other", t0) != nil {
+		t.Errorf("found presence in a minute or site with no one")
+	}
+
+	locs := []*Location{
+		{Site: site.Name, TimeStamp: t0},
+		{Site: site.Name, TimeStamp: t0.Add(time.Minute)},
+	}
+	lik := alloc(2, nroom)
+	for i := range lik {
+		for j := range lik[i] {
+			lik[i][j] = 0.5
+		}
+	}
+
+	pr.Boost(lik, locs, 2, site)
+
+	if math.Abs(lik[0][exam1.Code]-0.5*(1+2*0.9)) > 1e-12 {
+		t.Errorf("got likelihood %f for Exam1", lik[0][exam1.Code])
+	}
+	if lik[0][NoSignal] != 0.5 {
+		t.Errorf("virtual state likelihood was changed")
+	}
+	for j := range lik[1] {
+		if lik[1][j] != 0.5 {
+			t.Errorf("likelihood changed for a minute with no one present")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package rfid
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// QualityThresholds holds the largest acceptable fraction of the records for one
+// day that can be rejected, overall and for several specific reasons.  A zero
+// threshold is not checked.
+type QualityThresholds struct {
+
+	// Records rejected for any reason
+	Rejected float64
+
+	// Records from readers not in the site configuration
+	InvalidIP float64
+
+	// Patient records with no matching Clarity appointment
+	NoClarity float64
+
+	// Records with unparseable tags
+	InvalidTag float64
+}
+
+// Rejected returns the number of records that were read but not retained.
+func (rfi *RFIDinfo) Rejected() int {
+	return rfi.TotalRecs - rfi.FinalRecs
+}
+
+// rate returns n as a fraction of the total number of records.
+func (rfi *RFIDinfo) rate(n int) float64 {
+
+	if rfi.TotalRecs == 0 {
+		return 0
+	}
+
+	return float64(n) / float64(rfi.TotalRecs)
+}
+
+// RejectionRate returns the fraction of records that were read but not retained.
+func (rfi *RFIDinfo) RejectionRate() float64 {
+	return rfi.rate(rfi.Rejected())
+}
+
+// Check compares the rejection rates to the thresholds, sets Flags to describe
+// the thresholds that are exceeded, and returns true if there are none.
+func (rfi *RFIDinfo) Check(th *QualityThresholds) bool {
+
+	rfi.Flags = nil
+
+	invalidTag := rfi.InvalidTagLength + rfi.InvalidPatientTag + rfi.InvalidProviderTag + rfi.InconsistentTag
+
+	for _, q := range []struct {
+		name string
+		n    int
+		max  float64
+	}{
+		{"Rejected", rfi.Rejected(), th.Rejected},
+		{"InvalidIP", rfi.InvalidIP, th.InvalidIP},
+		{"NoClarity", rfi.NoClarity, th.NoClarity},
+		{"InvalidTag", invalidTag, th.InvalidTag},
+	} {
+		if q.max > 0 && rfi.rate(q.n) > q.max {
+			rfi.Flags = append(rfi.Flags, fmt.Sprintf("%s %.3f > %.3f", q.name, rfi.rate(q.n), q.max))
+		}
+	}
+
+	return len(rfi.Flags) == 0
+}
+
+// Add adds all the counts in other to rfi.
+func (rfi *RFIDinfo) Add(other *RFIDinfo) {
+
+	v := reflect.ValueOf(rfi).Elem()
+	w := reflect.ValueOf(other).Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.Int {
+			v.Field(i).SetInt(v.Field(i).Int() + w.Field(i).Int())
+		}
+	}
+}
+
+// WriteQualityCSV writes one row for each RFIDinfo value, with a column for each field.
+func WriteQualityCSV(w io.Writer, infos []*RFIDinfo) error {
+
+	wtr := csv.NewWriter(w)
+
+	t := reflect.TypeOf(RFIDinfo{})
+	var row []string
+	for i := 0; i < t.NumField(); i++ {
+		row = append(row, t.Field(i).Name)
+	}
+	row = append(row, "RejectionRate")
+	if err := wtr.Write(row); err != nil {
+		return err
+	}
+
+	for _, rfi := range infos {
+
+		row = row[0:0]
+		v := reflect.ValueOf(rfi).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			switch x := v.Field(i).Interface().(type) {
+			case []string:
+				row = append(row, strings.Join(x, "; "))
+			default:
+				row = append(row, fmt.Sprintf("%v", x))
+			}
+		}
+		row = append(row, fmt.Sprintf("%.4f", rfi.RejectionRate()))
+
+		if err := wtr.Write(row); err != nil {
+			return err
+		}
+	}
+
+	wtr.Flush()
+	return wtr.Error()
+}
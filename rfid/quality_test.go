@@ -0,0 +1,44 @@
+package rfid
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestQuality(t *testing.T) {
+
+	day1 := &RFIDinfo{Site: "main", Date: "2018-03-01", TotalRecs: 100, FinalRecs: 90, InvalidIP: 8, NoClarity: 2}
+	day2 := &RFIDinfo{Site: "main", Date: "2018-03-02", TotalRecs: 100, FinalRecs: 99, InvalidIP: 1}
+
+	th := &QualityThresholds{Rejected: 0.5, InvalidIP: 0.05}
+
+	if day1.Check(th) || len(day1.Flags) != 1 {
+		t.Errorf("day 1 should have one flag, has %v", day1.Flags)
+	}
+	if !day2.Check(th) || len(day2.Flags) != 0 {
+		t.Errorf("day 2 should not be flagged, has %v", day2.Flags)
+	}
+
+	summary := &RFIDinfo{Site: "all"}
+	summary.Add(day1)
+	summary.Add(day2)
+	if summary.TotalRecs != 200 || summary.FinalRecs != 189 || summary.InvalidIP != 9 || summary.Site != "all" {
+		t.Fail()
+	}
+	if summary.RejectionRate() != 11.0/200 {
+		t.Fail()
+	}
+
+	var buf bytes.Buffer
+	if err := WriteQualityCSV(&buf, []*RFIDinfo{day1, day2, summary}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[1][1] != "2018-03-01" || rows[1][len(rows[1])-1] != "0.1000" {
+		t.Errorf("unexpected csv: %v", rows)
+	}
+}
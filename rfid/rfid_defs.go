@@ -1,7 +1,7 @@
 package rfid
 
 import (
-	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -16,105 +16,24 @@ const (
 	Patient
 )
 
-// Type for integer codes for the rooms.
-type RoomCode uint8
+// Type for integer codes for the rooms.  The codes for physical rooms are
+// allocated at runtime from the site configuration.
+type RoomCode uint16
 
-// Integer odes for the rooms.  These need to start at zero because they are
-// used as array indices.
+// Integer codes for the virtual states, which are present at every site.
+// These need to start at zero because room codes are used as array indices,
+// the physical rooms are numbered starting from numVirtual.
 const (
-	Exam1 RoomCode = iota
-	Exam2
-	Exam3
-	Exam4
-	Exam5
-	Exam6
-	Exam7
-	Exam8
-	Exam9
-	Exam10
-	Exam11
-	Exam12
-	Field1
-	Field2
-	Field3
-	Field4
-	Field5
-	IOLMaster
-	Lensometer
-	Admin
-	Checkout
-	IPW9
-	IPW2
-	Treatment
-	NoSignal
-	CheckoutFinal // Absorbing checkout state, otherwise equivalent to Checkout
-	Checkin       // Equivalent to NoSignal, but only can occur at the beginning
-	Null          // Must be last, used to mark absent information for Room2
+	NoSignal      RoomCode = iota
+	CheckoutFinal          // Absorbing checkout state, otherwise equivalent to Checkout
+	Checkin                // Equivalent to NoSignal, but only can occur at the beginning
+	numVirtual
 )
 
-var (
-	// IPcode maps IP addresses to integer room codes.
-	IPcode = map[string]RoomCode{
-		"10.23.69.140":  Exam1,
-		"10.23.69.141":  Exam2,
-		"10.23.69.142":  Exam3,
-		"10.23.69.143":  Exam4,
-		"10.23.69.144":  Exam5,
-		"10.23.69.145":  Exam6,
-		"10.23.69.146":  Exam7,
-		"10.23.69.147":  Exam8,
-		"10.23.69.148":  Exam9,
-		"10.23.69.149":  Exam10,
-		"10.23.69.150":  Exam11,
-		"10.23.69.151":  Exam12,
-		"10.23.69.152":  Field1,
-		"10.23.69.153":  Field2,
-		"10.23.69.154":  Field3,
-		"10.23.69.155":  Field4,
-		"10.23.69.156":  Field5,
-		"10.23.69.157":  IOLMaster,
-		"10.23.69.158":  Lensometer,
-		"10.23.69.159":  Admin,
-		"10.23.69.160":  Checkout,
-		"10.23.69.161":  IPW9,
-		"10.23.69.162":  IPW2,
-		"10.23.69:163":  Treatment,
-		"NoSignal":      NoSignal,
-		"CheckoutFinal": CheckoutFinal,
-		"Checkin":       Checkin,
-	}
-
-	// IPmap maps IP address to room names.
-	IPmap = map[string]string{
-		"10.23.69.140":  "Exam1",
-		"10.23.69.141":  "Exam2",
-		"10.23.69.142":  "Exam3",
-		"10.23.69.143":  "Exam4",
-		"10.23.69.144":  "Exam5",
-		"10.23.69.145":  "Exam6",
-		"10.23.69.146":  "Exam7",
-		"10.23.69.147":  "Exam8",
-		"10.23.69.148":  "Exam9",
-		"10.23.69.149":  "Exam10",
-		"10.23.69.150":  "Exam11",
-		"10.23.69.151":  "Exam12",
-		"10.23.69.152":  "Field1",
-		"10.23.69.153":  "Field2",
-		"10.23.69.154":  "Field3",
-		"10.23.69.155":  "Field4",
-		"10.23.69.156":  "Field5",
-		"10.23.69.157":  "IOLMaster",
-		"10.23.69.158":  "Lensometer",
-		"10.23.69.159":  "Admin",
-		"10.23.69.160":  "Checkout",
-		"10.23.69.161":  "IPW9",
-		"10.23.69.162":  "IPW2",
-		"10.23.69:163":  "Treatment",
-		"NoSignal":      "NoSignal",
-		"CheckoutFinal": "CheckoutFinal",
-		"Checkin":       "Checkin",
-	}
+// Null is used to mark absent information for Room2.
+const Null RoomCode = math.MaxUint16
 
+var (
 	// PTmap maps person category codes to text labels.
 	PTmap = map[PersonType]string{
 		Provider: "Provider",
@@ -159,6 +78,9 @@ type RFIDrecord struct {
 	// Unique id
 	Ping uint64
 
+	// The name of the site where the ping was recorded
+	Site string
+
 	// The type of person corresponding to this record, either
 	// patient or provider.
 	PersonCat PersonType
@@ -197,12 +119,12 @@ type RFIDrecord struct {
 }
 
 // parsePatient parses a patient record from its raw input format into a struct.
-func (rec *RFIDrecord) parsePatient(tag string, rfi *RFIDinfo) bool {
+func (rec *RFIDrecord) parsePatient(tag string, rfi *RFIDinfo) error {
 
 	fld := strings.Split(tag, "F")
 	if len(fld) != 5 {
 		rfi.InvalidPatientTag++
-		return false
+		return &ParseError{Field: "patient tag", Value: tag, Err: errTagFields}
 	}
 
 	var err error
@@ -212,28 +134,28 @@ func (rec *RFIDrecord) parsePatient(tag string, rfi *RFIDinfo) bool {
 	rec.TagId, err = strconv.ParseUint(fld[0], 10, 64)
 	if err != nil {
 		rfi.InvalidPatientTagId++
-		return false
+		return &ParseError{Field: "patient tag id", Value: fld[0], Err: err}
 	}
 
 	if fld[1] != "0" {
 		rfi.InconsistentTag++
-		return false
+		return &ParseError{Field: "patient provider type", Value: fld[1], Err: errInconsistentTag}
 	}
 
 	rec.CSN, err = strconv.ParseUint(fld[2], 10, 64)
 	if err != nil {
 		rfi.InvalidPatientCSN++
-		return false
+		return &ParseError{Field: "CSN", Value: fld[2], Err: err}
 	}
 
 	var ok bool
 	rec.TagIssue, ok = parseMil(fld[3])
 	if !ok {
 		rfi.InvalidPatientDate++
-		return false
+		return &ParseError{Field: "patient tag date", Value: fld[3], Err: ErrDateFormat}
 	}
 
-	return true
+	return nil
 }
 
 // Parse a time string with format MMDDYYHHMM
@@ -273,12 +195,12 @@ func parseMil(mil string) (time.Time, bool) {
 }
 
 // parseProvider parses a provider tag from the input form into a struct.
-func (rec *RFIDrecord) parseProvider(tag string, rfi *RFIDinfo) bool {
+func (rec *RFIDrecord) parseProvider(tag string, rfi *RFIDinfo) error {
 
 	fld := strings.Split(tag, "F")
 	if len(fld) != 5 {
 		rfi.InvalidProviderTag++
-		return false
+		return &ParseError{Field: "provider tag", Value: tag, Err: errTagFields}
 	}
 
 	var err error
@@ -288,113 +210,145 @@ func (rec *RFIDrecord) parseProvider(tag string, rfi *RFIDinfo) bool {
 	rec.TagId, err = strconv.ParseUint(fld[0], 10, 64)
 	if err != nil {
 		rfi.InvalidProviderTagId++
-		return false
+		return &ParseError{Field: "provider tag id", Value: fld[0], Err: err}
 	}
 
 	pt, err := strconv.Atoi(fld[1])
 	if err != nil {
 		rfi.InvalidProviderType++
-		return false
+		return &ParseError{Field: "provider type", Value: fld[1], Err: err}
 	}
 	rec.ProviderCat = ProviderType(pt)
 
 	rec.UMid, err = strconv.ParseUint(fld[2], 10, 64)
 	if err != nil {
 		rfi.InvalidUMid++
-		return false
+		return &ParseError{Field: "UMid", Value: fld[2], Err: err}
 	}
 
 	if len(fld[3]) != 4 {
 		rfi.InvalidTagIssueDate++
-		return false
+		return &ParseError{Field: "provider tag date", Value: fld[3], Err: ErrDateFormat}
 	}
 
 	month, err := strconv.Atoi(fld[3][0:2])
 	if err != nil {
 		rfi.InvalidTagIssueDate++
-		return false
+		return &ParseError{Field: "provider tag date", Value: fld[3], Err: err}
 	}
 
 	year, err := strconv.Atoi(fld[3][2:4])
 	if err != nil {
 		rfi.InvalidTagIssueDate++
-		return false
+		return &ParseError{Field: "provider tag date", Value: fld[3], Err: err}
 	}
 	year += 2000
 
 	rec.TagIssue = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
 
-	return true
+	return nil
+}
+
+// ParseTimeStamp parses the time stamp of a ping in the raw data, which has the
+// format YYYY-MM-DD HH:MM:SS in UTC.  If it can't be parsed, a *ParseError wrapping
+// ErrDateFormat is returned.
+func ParseTimeStamp(s string) (time.Time, error) {
+
+	tm := []byte(s)
+	if len(tm) <= 10 {
+		return time.Time{}, &ParseError{Field: "time stamp", Value: s, Err: ErrDateFormat}
+	}
+	tm[10] = 'T'
+	tm = append(tm, 'Z')
+
+	t, err := time.Parse(time.RFC3339, string(tm))
+	if err != nil {
+		return time.Time{}, &ParseError{Field: "time stamp", Value: s, Err: ErrDateFormat}
+	}
+
+	return t, nil
 }
 
 // Parse takes a row of raw data, split into text tokens, and uses it
-// to populate an RFID tag struct.
-func (rec *RFIDrecord) Parse(f []string, rfi *RFIDinfo) bool {
+// to populate an RFID tag struct.  The site configuration is used to
+// map reader IP addresses to rooms, and to calibrate the signals.  If the
+// row is invalid, the problem is counted in rfi and a *ParseError naming
+// the field is returned.  The file name and line number of the error are
+// left for the caller to fill in.
+func (rec *RFIDrecord) Parse(f []string, site *SiteConfig, rfi *RFIDinfo) error {
 
 	var err error
 
+	if len(f) < 6 {
+		rfi.InvalidFieldCount++
+		return &ParseError{Field: "row", Value: strings.Join(f, ","), Err: ErrFieldCount}
+	}
+
 	rec.Ping, err = strconv.ParseUint(f[0], 10, 64)
 	if err != nil {
 		rfi.InvalidPing++
-		return false
+		return &ParseError{Field: "ping", Value: f[0], Err: err}
 	}
 
-	// Get the IP address as a numeric code
-	c, ok := IPcode[f[1]]
-	if !ok {
-		// Not a known IP address
-		rfi.InvalidIP++
-		return false
-	}
-	rec.IP = c
+	rec.Site = site.Name
 
 	switch len(f[2]) {
 	case 24:
 		// Provider record
-		if !rec.parseProvider(f[2], rfi) {
-			return false
+		if err := rec.parseProvider(f[2], rfi); err != nil {
+			return err
 		}
 	case 32:
 		// Patient record
-		if !rec.parsePatient(f[2], rfi) {
-			return false
+		if err := rec.parsePatient(f[2], rfi); err != nil {
+			return err
 		}
 	default:
 		rfi.InvalidTagLength++
-		return false
+		return &ParseError{Field: "tag", Value: f[2], Err: errTagLength}
 	}
 
-	tm := []byte(f[3])
-	tm[10] = 'T'
-	tm = append(tm, 'Z')
-	rec.TimeStamp, err = time.Parse(time.RFC3339, string(tm))
+	rec.TimeStamp, err = ParseTimeStamp(f[3])
 	if err != nil {
-		fmt.Printf("%v\n", err)
 		rfi.InvalidTimeStamp++
-		return false
+		return err
+	}
+
+	// Get the IP address as a numeric code.  The room containing a reader
+	// can change over time, so this needs the time stamp.
+	c, ok := site.RoomCode(f[1], rec.TimeStamp)
+	if !ok {
+		// Not a known IP address
+		rfi.InvalidIP++
+		return &ParseError{Field: "reader IP", Value: f[1], Err: errUnknownReader}
 	}
+	rec.IP = c
 
 	s, err := strconv.ParseFloat(f[4], 64)
 	if err != nil {
 		rfi.InvalidSignal++
-		return false
+		return &ParseError{Field: "signal", Value: f[4], Err: err}
 	}
-	rec.Signal = float32(s)
+	rec.Signal = float32(site.Calibrate(f[1], s))
 
 	r, err := strconv.Atoi(f[5])
 	if err != nil {
 		rfi.InvalidReadCount++
-		return false
+		return &ParseError{Field: "read count", Value: f[5], Err: err}
 	}
 	rec.Reads = uint16(r)
 
-	return true
+	return nil
 }
 
 // RFIDinfo contains summary information obtained after processing the
 // data for one complete day.
 type RFIDinfo struct {
+	Site                 string
+	Date                 string
 	FileName             string
+	CSVErrors            int
+	InvalidFieldCount    int
 	InvalidPing          int
 	InvalidIP            int
 	InvalidTagLength     int
@@ -420,4 +374,7 @@ type RFIDinfo struct {
 	BeforeCheckIn        int
 	AfterCheckOut        int
 	TimeSpanFull         int
+
+	// Descriptions of the quality thresholds exceeded on this day
+	Flags []string
 }
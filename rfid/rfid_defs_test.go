@@ -0,0 +1,67 @@
+package rfid
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rec RFIDrecord
+	var rfi RFIDinfo
+	f := strings.Split("2023,10.23.69.140,00501F4F900000001F0318FX,2018-03-01 08:00:12,-63.5,4", ",")
+	if err := rec.Parse(f, site, &rfi); err != nil {
+		t.Fatal(err)
+	}
+	if rec.PersonCat != Provider || rec.TagId != 501 || rec.UMid != 900000001 || rec.Reads != 4 {
+		t.Errorf("record parsed incorrectly: %+v", rec)
+	}
+
+	for _, c := range []struct {
+		row   string
+		field string
+	}{
+		{"2023,10.23.69.140,00501F4F900000001F0318FX,2018-03-01 08:00:12,-63.5", "row"},
+		{"x,10.23.69.140,00501F4F900000001F0318FX,2018-03-01 08:00:12,-63.5,4", "ping"},
+		{"2023,10.23.69.140,00501F4F900000001F0318,2018-03-01 08:00:12,-63.5,4", "tag"},
+		{"2023,10.23.69.140,00501FxF900000001F0318FX,2018-03-01 08:00:12,-63.5,4", "provider type"},
+		{"2023,10.23.69.140,00501F4F900000001F0318FX,2018-03-01,-63.5,4", "time stamp"},
+		{"2023,10.1.1.1,00501F4F900000001F0318FX,2018-03-01 08:00:12,-63.5,4", "reader IP"},
+		{"2023,10.23.69.140,00501F4F900000001F0318FX,2018-03-01 08:00:12,strong,4", "signal"},
+		{"2023,10.23.69.140,00501F4F900000001F0318FX,2018-03-01 08:00:12,-63.5,", "read count"},
+	} {
+		err := new(RFIDrecord).Parse(strings.Split(c.row, ","), site, &rfi)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: got %v, expected a ParseError", c.row, err)
+			continue
+		}
+		if perr.Field != c.field {
+			t.Errorf("%s: got field '%s', expected '%s'", c.row, perr.Field, c.field)
+		}
+	}
+
+	if rfi.InvalidFieldCount != 1 || rfi.InvalidIP != 1 || rfi.InvalidSignal != 1 {
+		t.Errorf("invalid records not counted: %+v", rfi)
+	}
+
+	// The same error for a bad time stamp whether or not the whole row is parsed
+	f = strings.Split("2023,10.23.69.140,00501F4F900000001F0318FX,2018-03-01,-63.5,4", ",")
+	if err := new(RFIDrecord).Parse(f, site, &rfi); !errors.Is(err, ErrDateFormat) {
+		t.Errorf("got %v, expected ErrDateFormat", err)
+	}
+	if _, err := ParseTimeStamp(f[3]); !errors.Is(err, ErrDateFormat) {
+		t.Errorf("got %v, expected ErrDateFormat", err)
+	}
+
+	perr := &ParseError{File: "a.csv.gz", Line: 3, Field: "signal", Value: "x", Err: ErrFieldCount}
+	if !strings.HasPrefix(perr.Error(), "a.csv.gz:3: invalid signal 'x'") {
+		t.Errorf("got message '%s'", perr.Error())
+	}
+}
@@ -0,0 +1,261 @@
+package rfid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Role describes the smoothing model for a group of people, such as patients or one
+// kind of provider.  The model is built from the standard model for the person type,
+// changed by the weights given here.  The weights are indexed by room name or by room
+// category label, and the room name is used if both are present.
+type Role struct {
+
+	// The name of the role, e.g. technician
+	Name string `json:"name"`
+
+	// The type of person, "patient" or "provider"
+	Person string `json:"person"`
+
+	// The provider categories in this role (labels as in ProvMap), all providers
+	// if empty.  Must be empty for patients.
+	ProviderTypes []string `json:"provider_types,omitempty"`
+
+	// Multiplies the starting probabilities of the rooms, 1 if not given
+	Start map[string]float64 `json:"start,omitempty"`
+
+	// The weight of staying in the same room from one minute to the next, relative
+	// to moving to another room, or 0 for the standard value
+	Stay float64 `json:"stay,omitempty"`
+
+	// Multiplies the probabilities of moving into the rooms, 1 if not given.  A
+	// weight of 0 makes the rooms unreachable.
+	Move map[string]float64 `json:"move,omitempty"`
+
+	// The probability of observing the true room relative to observing any other
+	// room, or 0 for the standard value
+	Same float64 `json:"same,omitempty"`
+
+	// The mean dwell times in minutes in the rooms, used by the HSMM, the standard
+	// values if not given
+	Dwell map[string]float64 `json:"dwell,omitempty"`
+
+	// The parsed person type and provider categories
+	person    PersonType
+	providers map[ProviderType]bool
+}
+
+// RoleConfig is a list of roles.  Each person is smoothed with the first role that
+// matches their person type and provider category.
+type RoleConfig struct {
+	Roles []*Role `json:"roles"`
+}
+
+// DefaultRole returns the role used for people of the given type when no configured
+// role matches, which uses the standard model.
+func DefaultRole(pt PersonType) *Role {
+
+	role := &Role{Name: "patient", Person: "patient", person: Patient}
+	if pt == Provider {
+		role = &Role{Name: "provider", Person: "provider", person: Provider}
+	}
+
+	return role
+}
+
+// LoadRoleConfig reads and validates a role configuration from a JSON file.
+func LoadRoleConfig(fname string) (*RoleConfig, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	cfg, err := ReadRoleConfig(fid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return cfg, nil
+}
+
+// ReadRoleConfig reads and validates a role configuration in JSON format.
+func ReadRoleConfig(r io.Reader) (*RoleConfig, error) {
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	cfg := new(RoleConfig)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the roles, and parses the person types and provider categories.
+func (cfg *RoleConfig) Validate() error {
+
+	provCodes := make(map[string]ProviderType)
+	for k, v := range ProvMap {
+		provCodes[v] = k
+	}
+
+	names := make(map[string]bool)
+	for _, role := range cfg.Roles {
+
+		if role.Name == "" {
+			return fmt.Errorf("role with no name")
+		}
+		if names[role.Name] {
+			return fmt.Errorf("duplicate role '%s'", role.Name)
+		}
+		names[role.Name] = true
+
+		pt, ok := personTypeCodes[role.Person]
+		if !ok {
+			return fmt.Errorf("role '%s': unknown person type '%s'", role.Name, role.Person)
+		}
+		role.person = pt
+
+		if pt == Patient && len(role.ProviderTypes) > 0 {
+			return fmt.Errorf("role '%s': provider types given for patients", role.Name)
+		}
+
+		role.providers = nil
+		for _, p := range role.ProviderTypes {
+			c, ok := provCodes[p]
+			if !ok {
+				return fmt.Errorf("role '%s': unknown provider type '%s'", role.Name, p)
+			}
+			if role.providers == nil {
+				role.providers = make(map[ProviderType]bool)
+			}
+			role.providers[c] = true
+		}
+
+		if role.Stay < 0 || role.Same < 0 {
+			return fmt.Errorf("role '%s': negative stay or same weight", role.Name)
+		}
+
+		for _, m := range []map[string]float64{role.Start, role.Move} {
+			for k, v := range m {
+				if v < 0 {
+					return fmt.Errorf("role '%s': negative weight for '%s'", role.Name, k)
+				}
+			}
+		}
+		for k, v := range role.Dwell {
+			if v <= 0 {
+				return fmt.Errorf("role '%s': dwell time for '%s' must be positive", role.Name, k)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckSites returns an error if a role has a weight for a name that is neither a
+// room category label nor the name of a room at one of the sites.
+func (cfg *RoleConfig) CheckSites(sites []*SiteConfig) error {
+
+	known := func(name string) bool {
+		for _, label := range roomCategoryNames {
+			if label == name {
+				return true
+			}
+		}
+		for _, site := range sites {
+			if site.RoomByName(name) != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, role := range cfg.Roles {
+		for _, m := range []map[string]float64{role.Start, role.Move, role.Dwell} {
+			for k := range m {
+				if !known(k) {
+					return fmt.Errorf("role '%s': unknown room or room category '%s'", role.Name, k)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Find returns the first role for people of the given type and provider category,
+// or nil if there is none.
+func (cfg *RoleConfig) Find(pt PersonType, cat ProviderType) *Role {
+
+	for _, role := range cfg.Roles {
+		if role.Matches(pt, cat) {
+			return role
+		}
+	}
+
+	return nil
+}
+
+// PersonType returns the type of person in the role.
+func (role *Role) PersonType() PersonType {
+	return role.person
+}
+
+// Matches returns true if the role is for people of the given type and provider
+// category.  The category is ignored for patients.
+func (role *Role) Matches(pt PersonType, cat ProviderType) bool {
+
+	if pt != role.person {
+		return false
+	}
+
+	return pt == Patient || role.providers == nil || role.providers[cat]
+}
+
+// StartWeight returns the multiplier of the starting probability of a room.
+func (role *Role) StartWeight(room *Room) float64 {
+
+	if v, ok := lookupRoom(role.Start, room); ok {
+		return v
+	}
+
+	return 1
+}
+
+// MoveWeight returns the multiplier of the probability of moving into a room.
+func (role *Role) MoveWeight(room *Room) float64 {
+
+	if v, ok := lookupRoom(role.Move, room); ok {
+		return v
+	}
+
+	return 1
+}
+
+// DwellMean returns the mean dwell time in minutes in a room.  The second return
+// value is false if the role does not give one, so that the standard value is used.
+func (role *Role) DwellMean(room *Room) (float64, bool) {
+	return lookupRoom(role.Dwell, room)
+}
+
+// lookupRoom returns the value in m for a room, looked up by the room name and then
+// by the room category label.  The second return value is false if neither is present.
+func lookupRoom(m map[string]float64, room *Room) (float64, bool) {
+
+	if v, ok := m[room.Name]; ok {
+		return v, true
+	}
+
+	v, ok := m[room.Category.String()]
+	return v, ok
+}
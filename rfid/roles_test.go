@@ -0,0 +1,97 @@
+package rfid
+
+import (
+	"strings"
+	"testing"
+)
+
+// The role configuration shipped with the repository.
+func TestRoleConfigDefault(t *testing.T) {
+
+	cfg, err := LoadRoleConfig("../roles.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.CheckSites([]*SiteConfig{site}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		pt   PersonType
+		cat  ProviderType
+		role string
+	}{
+		{Patient, 0, "patients"},
+		{Provider, Technician, "technicians"},
+		{Provider, Fellow, "attendings"},
+		{Provider, Imaging, "imaging"},
+		{Provider, Clerk, "clerks"},
+	} {
+		role := cfg.Find(c.pt, c.cat)
+		if role == nil || role.Name != c.role {
+			t.Errorf("%v %v: got role %v, expected %s", c.pt, c.cat, role, c.role)
+		}
+	}
+
+	// No role for these providers, so the default is used
+	if role := cfg.Find(Provider, Educator); role != nil {
+		t.Errorf("got role %s for an educator", role.Name)
+	}
+	if !DefaultRole(Provider).Matches(Provider, Educator) || DefaultRole(Provider).Matches(Patient, 0) {
+		t.Errorf("default provider role matches the wrong people")
+	}
+
+	// Room names take precedence over categories
+	role := &Role{Start: map[string]float64{"exam": 2, "Exam3": 5}}
+	if w := role.StartWeight(site.RoomByName("Exam3")); w != 5 {
+		t.Errorf("got start weight %f for Exam3, expected 5", w)
+	}
+	if w := role.StartWeight(site.RoomByName("Exam1")); w != 2 {
+		t.Errorf("got start weight %f for Exam1, expected 2", w)
+	}
+	if w := role.MoveWeight(site.RoomByName("Exam1")); w != 1 {
+		t.Errorf("got move weight %f for Exam1, expected 1", w)
+	}
+	if _, ok := role.DwellMean(site.RoomByName("Exam1")); ok {
+		t.Errorf("got a dwell time that was not configured")
+	}
+}
+
+func TestRoleConfigValidate(t *testing.T) {
+
+	for _, s := range []string{
+		// Unknown person type
+		`{"roles": [{"name": "a", "person": "visitor"}]}`,
+		// Unknown provider type
+		`{"roles": [{"name": "a", "person": "provider", "provider_types": ["Janitor"]}]}`,
+		// Provider types for patients
+		`{"roles": [{"name": "a", "person": "patient", "provider_types": ["Clerk"]}]}`,
+		// Duplicate names
+		`{"roles": [{"name": "a", "person": "patient"}, {"name": "a", "person": "provider"}]}`,
+		// Negative weight
+		`{"roles": [{"name": "a", "person": "patient", "move": {"exam": -1}}]}`,
+		// Zero dwell time
+		`{"roles": [{"name": "a", "person": "patient", "dwell": {"exam": 0}}]}`,
+	} {
+		if _, err := ReadRoleConfig(strings.NewReader(s)); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadRoleConfig(strings.NewReader(`{"roles": [{"name": "a", "person": "patient", "start": {"Exam99": 1}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CheckSites([]*SiteConfig{site}) == nil {
+		t.Errorf("unknown room was accepted")
+	}
+}
@@ -0,0 +1,455 @@
+package rfid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// RoomCategory is an integer code for the kind of room a reader is located in.
+type RoomCategory uint8
+
+// Codes for the room categories
+const (
+	OtherRoom RoomCategory = iota
+	ExamRoom
+	FieldRoom
+	ImagingRoom
+	AdminRoom
+	CheckoutRoom
+	VirtualRoom // A state that does not correspond to a physical reader
+)
+
+var (
+	// roomCategoryNames maps room category codes to the labels used
+	// in the site configuration file.
+	roomCategoryNames = map[RoomCategory]string{
+		OtherRoom:    "other",
+		ExamRoom:     "exam",
+		FieldRoom:    "field",
+		ImagingRoom:  "imaging",
+		AdminRoom:    "admin",
+		CheckoutRoom: "checkout",
+		VirtualRoom:  "virtual",
+	}
+
+	// personTypeCodes maps the person type labels used in the site
+	// configuration file to their codes.
+	personTypeCodes = map[string]PersonType{
+		"patient":  Patient,
+		"provider": Provider,
+	}
+
+	// virtualCodes maps the names of the virtual states to their room codes.
+	virtualCodes = map[string]RoomCode{
+		"NoSignal":      NoSignal,
+		"CheckoutFinal": CheckoutFinal,
+		"Checkin":       Checkin,
+	}
+)
+
+// dateFormat is the layout of the reader validity dates in the site configuration.
+const dateFormat = "2006-01-02"
+
+// String returns the configuration label for a room category.
+func (c RoomCategory) String() string {
+	return roomCategoryNames[c]
+}
+
+// MarshalJSON writes a room category using its text label.
+func (c RoomCategory) MarshalJSON() ([]byte, error) {
+	s, ok := roomCategoryNames[c]
+	if !ok {
+		return nil, fmt.Errorf("unknown room category %d", c)
+	}
+	return json.Marshal(s)
+}
+
+// UnmarshalJSON reads a room category from its text label.
+func (c *RoomCategory) UnmarshalJSON(b []byte) error {
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	for k, v := range roomCategoryNames {
+		if v == s {
+			*c = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown room category '%s'", s)
+}
+
+// Room describes one room of the clinic, or a virtual state such as
+// NoSignal that is not associated with any reader.
+type Room struct {
+
+	// The room name, e.g. Exam1
+	Name string `json:"name"`
+
+	// The kind of room
+	Category RoomCategory `json:"category"`
+
+	// The types of people ("patient", "provider") who can be in this room,
+	// everyone if empty
+	Persons []string `json:"persons,omitempty"`
+
+	// The integer code for the room, assigned when the configuration is validated
+	Code RoomCode `json:"-"`
+
+	// The parsed person types, nil if everyone is allowed
+	persons map[PersonType]bool
+}
+
+// Reader describes one RFID reader and the room in which it is mounted.
+type Reader struct {
+
+	// The IP address of the reader
+	IP string `json:"ip"`
+
+	// The name of the room containing the reader
+	Room string `json:"room"`
+
+	// The reader is in this room from this date (inclusive), formatted
+	// YYYY-MM-DD.  Empty means no lower bound.
+	From string `json:"from,omitempty"`
+
+	// The reader is in this room until this date (exclusive), formatted
+	// YYYY-MM-DD.  Empty means no upper bound.
+	To string `json:"to,omitempty"`
+
+	// Parsed validity dates
+	from time.Time
+	to   time.Time
+}
+
+// SiteConfig describes the rooms and readers of one clinic.
+type SiteConfig struct {
+
+	// The name of the site, which identifies the site in all records
+	Name string `json:"name"`
+
+	// The directory containing the raw RFID files for the site
+	APDDir string `json:"apd_dir"`
+
+	// The directory containing the Clarity extracts for the site
+	ClarityDir string `json:"clarity_dir"`
+
+	// All rooms and virtual states
+	Rooms []*Room `json:"rooms"`
+
+	// All readers
+	Readers []*Reader `json:"readers"`
+
+	// How people can move between the rooms, if nil they can move between
+	// any two rooms
+	FloorPlan *FloorPlan `json:"floor_plan,omitempty"`
+
+	// Shortest walking distances between the physical rooms for each type of
+	// person, indexed by room code less the number of virtual states
+	dist map[PersonType][][]float64
+
+	// Per-reader signal corrections, nil if the signals are used as received
+	cal *Calibration
+
+	// Readers indexed by IP address
+	readers map[string][]*Reader
+
+	// Rooms indexed by name and by code
+	byName map[string]*Room
+	byCode map[RoomCode]*Room
+}
+
+// LoadSiteConfig reads and validates a site configuration from a JSON file.
+func LoadSiteConfig(fname string) (*SiteConfig, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	site, err := ReadSiteConfig(fid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	return site, nil
+}
+
+// LoadSiteConfigs reads and validates the configurations of several
+// sites, which must have distinct names.
+func LoadSiteConfigs(fnames []string) ([]*SiteConfig, error) {
+
+	var sites []*SiteConfig
+	names := make(map[string]bool)
+
+	for _, fname := range fnames {
+
+		site, err := LoadSiteConfig(fname)
+		if err != nil {
+			return nil, err
+		}
+
+		if names[site.Name] {
+			return nil, fmt.Errorf("%s: duplicate site '%s'", fname, site.Name)
+		}
+		names[site.Name] = true
+
+		sites = append(sites, site)
+	}
+
+	return sites, nil
+}
+
+// ReadSiteConfig reads and validates a site configuration in JSON format.
+func ReadSiteConfig(r io.Reader) (*SiteConfig, error) {
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	site := new(SiteConfig)
+	if err := dec.Decode(site); err != nil {
+		return nil, err
+	}
+
+	if err := site.Validate(); err != nil {
+		return nil, err
+	}
+
+	return site, nil
+}
+
+// Validate checks the configuration for consistency, and builds the
+// lookup tables used to map readers to rooms.
+func (site *SiteConfig) Validate() error {
+
+	if site.Name == "" {
+		return fmt.Errorf("site has no name")
+	}
+
+	site.byName = make(map[string]*Room)
+	site.byCode = make(map[RoomCode]*Room)
+
+	// Physical rooms are numbered in the order that they appear, following the
+	// virtual states.
+	next := numVirtual
+
+	for _, room := range site.Rooms {
+
+		if room.Name == "" {
+			return fmt.Errorf("room with no name")
+		}
+
+		if _, ok := site.byName[room.Name]; ok {
+			return fmt.Errorf("duplicate room '%s'", room.Name)
+		}
+
+		c, virtual := virtualCodes[room.Name]
+		switch {
+		case virtual && room.Category != VirtualRoom:
+			return fmt.Errorf("room '%s' must have category 'virtual'", room.Name)
+		case !virtual && room.Category == VirtualRoom:
+			return fmt.Errorf("unknown virtual room '%s'", room.Name)
+		case !virtual:
+			if next == Null {
+				return fmt.Errorf("too many rooms")
+			}
+			c = next
+			next++
+		}
+		room.Code = c
+
+		var err error
+		if room.persons, err = parsePersons(room.Persons); err != nil {
+			return fmt.Errorf("room '%s': %v", room.Name, err)
+		}
+
+		site.byName[room.Name] = room
+		site.byCode[c] = room
+	}
+
+	// Every room code is used as an array index, so all virtual states must be present.
+	for name := range virtualCodes {
+		if _, ok := site.byName[name]; !ok {
+			return fmt.Errorf("virtual room '%s' is not configured", name)
+		}
+	}
+
+	site.readers = make(map[string][]*Reader)
+
+	for _, rdr := range site.Readers {
+
+		if net.ParseIP(rdr.IP) == nil {
+			return fmt.Errorf("invalid IP address '%s' for room '%s'", rdr.IP, rdr.Room)
+		}
+
+		room, ok := site.byName[rdr.Room]
+		if !ok {
+			return fmt.Errorf("reader '%s' is in unknown room '%s'", rdr.IP, rdr.Room)
+		}
+		if room.Category == VirtualRoom {
+			return fmt.Errorf("reader '%s' is in virtual room '%s'", rdr.IP, rdr.Room)
+		}
+
+		var err error
+		rdr.from, rdr.to = time.Time{}, time.Time{}
+		if rdr.From != "" {
+			if rdr.from, err = time.Parse(dateFormat, rdr.From); err != nil {
+				return fmt.Errorf("reader '%s': invalid date '%s'", rdr.IP, rdr.From)
+			}
+		}
+		if rdr.To != "" {
+			if rdr.to, err = time.Parse(dateFormat, rdr.To); err != nil {
+				return fmt.Errorf("reader '%s': invalid date '%s'", rdr.IP, rdr.To)
+			}
+			if !rdr.to.After(rdr.from) {
+				return fmt.Errorf("reader '%s': empty validity range", rdr.IP)
+			}
+		}
+
+		// The same IP address may appear several times if the reader was moved, but
+		// the validity ranges cannot overlap.
+		for _, other := range site.readers[rdr.IP] {
+			if rdr.overlaps(other) {
+				return fmt.Errorf("duplicate reader '%s' in rooms '%s' and '%s'", rdr.IP, other.Room, rdr.Room)
+			}
+		}
+
+		site.readers[rdr.IP] = append(site.readers[rdr.IP], rdr)
+	}
+
+	return site.setupFloorPlan()
+}
+
+// overlaps returns true if the validity ranges of two readers intersect.
+func (rdr *Reader) overlaps(other *Reader) bool {
+
+	if !rdr.to.IsZero() && !other.from.Before(rdr.to) {
+		return false
+	}
+	if !other.to.IsZero() && !rdr.from.Before(other.to) {
+		return false
+	}
+
+	return true
+}
+
+// valid returns true if the reader is in its configured room at the given time.
+func (rdr *Reader) valid(t time.Time) bool {
+
+	if !rdr.from.IsZero() && t.Before(rdr.from) {
+		return false
+	}
+	if !rdr.to.IsZero() && !t.Before(rdr.to) {
+		return false
+	}
+
+	return true
+}
+
+// parsePersons returns the set of person types with the given labels, or nil if
+// there are no labels.
+func parsePersons(names []string) (map[PersonType]bool, error) {
+
+	var persons map[PersonType]bool
+	for _, p := range names {
+		pt, ok := personTypeCodes[p]
+		if !ok {
+			return nil, fmt.Errorf("unknown person type '%s'", p)
+		}
+		if persons == nil {
+			persons = make(map[PersonType]bool)
+		}
+		persons[pt] = true
+	}
+
+	return persons, nil
+}
+
+// Allows returns true if people of the given type can be in the room.
+func (room *Room) Allows(pt PersonType) bool {
+	return room.persons == nil || room.persons[pt]
+}
+
+// RoomCode returns the code of the room containing the reader with the
+// given IP address at the given time.  The second return value is false
+// if the reader is unknown or was not in service at that time.
+func (site *SiteConfig) RoomCode(ip string, t time.Time) (RoomCode, bool) {
+
+	for _, rdr := range site.readers[ip] {
+		if rdr.valid(t) {
+			return site.byName[rdr.Room].Code, true
+		}
+	}
+
+	return 0, false
+}
+
+// SetCalibration sets the corrections applied to the signals of the readers when
+// records are parsed, or removes them if cal is nil.  The calibration must be for
+// this site, and can only include configured readers.
+func (site *SiteConfig) SetCalibration(cal *Calibration) error {
+
+	if cal == nil {
+		site.cal = nil
+		return nil
+	}
+
+	if cal.Site != site.Name {
+		return fmt.Errorf("calibration for site '%s' used with site '%s'", cal.Site, site.Name)
+	}
+
+	for ip := range cal.Readers {
+		if _, ok := site.readers[ip]; !ok {
+			return fmt.Errorf("calibration for unknown reader '%s'", ip)
+		}
+	}
+
+	site.cal = cal
+	return nil
+}
+
+// Calibrate returns the calibrated value of a signal received by the reader with the
+// given IP address, or the signal itself if there is no calibration.
+func (site *SiteConfig) Calibrate(ip string, signal float64) float64 {
+
+	if site.cal == nil {
+		return signal
+	}
+
+	return site.cal.Apply(ip, signal)
+}
+
+// RoomByName returns the room with the given name, or nil if there is no such room.
+func (site *SiteConfig) RoomByName(name string) *Room {
+	return site.byName[name]
+}
+
+// Room returns the room with the given code, or nil if there is no such room.
+func (site *SiteConfig) Room(c RoomCode) *Room {
+	return site.byCode[c]
+}
+
+// RoomName returns the name of the room with the given code, or an empty
+// string if there is no such room.
+func (site *SiteConfig) RoomName(c RoomCode) string {
+
+	room, ok := site.byCode[c]
+	if !ok {
+		return ""
+	}
+
+	return room.Name
+}
+
+// NumRooms returns the number of rooms, including virtual states.
+func (site *SiteConfig) NumRooms() int {
+	return len(site.Rooms)
+}
@@ -0,0 +1,174 @@
+package rfid
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The site configuration shipped with the repository.
+func TestSiteConfigDefault(t *testing.T) {
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	for ip, room := range map[string]string{
+		"10.23.69.140": "Exam1",
+		"10.23.69.158": "Lensometer",
+		"10.23.69.163": "Treatment",
+	} {
+		c, ok := site.RoomCode(ip, tm)
+		if !ok || site.RoomName(c) != room {
+			t.Errorf("%s: got '%s', expected '%s'", ip, site.RoomName(c), room)
+		}
+	}
+
+	if _, ok := site.RoomCode("10.23.69:163", tm); ok {
+		t.Fail()
+	}
+}
+
+// replaceReaders returns the default site configuration with the readers replaced.
+func replaceReaders(t *testing.T, readers string) string {
+
+	site, err := LoadSiteConfig("../site.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rooms []string
+	for _, r := range site.Rooms {
+		rooms = append(rooms, `{"name": "`+r.Name+`", "category": "`+r.Category.String()+`"}`)
+	}
+
+	return `{"name": "test", "rooms": [` + strings.Join(rooms, ",") + `], "readers": [` + readers + `]}`
+}
+
+func TestSiteConfigValidate(t *testing.T) {
+
+	for _, q := range []struct {
+		readers string
+		valid   bool
+	}{
+		{
+			readers: `{"ip": "10.23.69.140", "room": "Exam1"}`,
+			valid:   true,
+		},
+		{
+			// Malformed IP address
+			readers: `{"ip": "10.23.69:140", "room": "Exam1"}`,
+			valid:   false,
+		},
+		{
+			// Unknown room
+			readers: `{"ip": "10.23.69.140", "room": "Exam99"}`,
+			valid:   false,
+		},
+		{
+			// Readers can't be placed in virtual rooms
+			readers: `{"ip": "10.23.69.140", "room": "NoSignal"}`,
+			valid:   false,
+		},
+		{
+			// Duplicate reader
+			readers: `{"ip": "10.23.69.140", "room": "Exam1"}, {"ip": "10.23.69.140", "room": "Exam2"}`,
+			valid:   false,
+		},
+		{
+			// A reader moved between rooms
+			readers: `{"ip": "10.23.69.140", "room": "Exam1", "to": "2018-06-01"},
+			          {"ip": "10.23.69.140", "room": "Exam2", "from": "2018-06-01"}`,
+			valid: true,
+		},
+		{
+			// Overlapping validity ranges
+			readers: `{"ip": "10.23.69.140", "room": "Exam1", "to": "2018-06-02"},
+			          {"ip": "10.23.69.140", "room": "Exam2", "from": "2018-06-01"}`,
+			valid: false,
+		},
+		{
+			// Malformed date
+			readers: `{"ip": "10.23.69.140", "room": "Exam1", "to": "06/01/2018"}`,
+			valid:   false,
+		},
+	} {
+		_, err := ReadSiteConfig(strings.NewReader(replaceReaders(t, q.readers)))
+		if (err == nil) != q.valid {
+			t.Errorf("%s: unexpected result %v", q.readers, err)
+		}
+	}
+
+	// Duplicate rooms
+	cfg := `{"name": "test", "rooms": [{"name": "Exam1", "category": "exam"}, {"name": "Exam1", "category": "exam"}]}`
+	if _, err := ReadSiteConfig(strings.NewReader(cfg)); err == nil {
+		t.Fail()
+	}
+}
+
+func TestSiteConfigDates(t *testing.T) {
+
+	cfg := replaceReaders(t, `{"ip": "10.23.69.140", "room": "Exam1", "to": "2018-06-01"},
+		{"ip": "10.23.69.140", "room": "Exam2", "from": "2018-06-01"}`)
+
+	site, err := ReadSiteConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := site.RoomCode("10.23.69.140", time.Date(2018, 5, 31, 23, 59, 0, 0, time.UTC))
+	if c != site.RoomByName("Exam1").Code {
+		t.Fail()
+	}
+
+	c, _ = site.RoomCode("10.23.69.140", time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC))
+	if c != site.RoomByName("Exam2").Code {
+		t.Fail()
+	}
+}
+
+// Room codes are allocated from the configuration, so large sites are supported.
+func TestSiteConfigManyRooms(t *testing.T) {
+
+	rooms := []string{`{"name": "NoSignal", "category": "virtual"}`,
+		`{"name": "CheckoutFinal", "category": "virtual"}`,
+		`{"name": "Checkin", "category": "virtual"}`}
+	var readers []string
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("Exam%d", i)
+		rooms = append(rooms, `{"name": "`+name+`", "category": "exam"}`)
+		readers = append(readers, fmt.Sprintf(`{"ip": "10.23.%d.%d", "room": "%s"}`, i/100, i%100, name))
+	}
+	cfg := `{"name": "big", "rooms": [` + strings.Join(rooms, ",") + `], "readers": [` + strings.Join(readers, ",") + `]}`
+
+	site, err := ReadSiteConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if site.NumRooms() != 303 {
+		t.Fail()
+	}
+
+	seen := make(map[RoomCode]bool)
+	for _, room := range site.Rooms {
+		if int(room.Code) >= site.NumRooms() || seen[room.Code] {
+			t.Errorf("invalid code %d for room '%s'", room.Code, room.Name)
+		}
+		seen[room.Code] = true
+	}
+
+	c, ok := site.RoomCode("10.23.2.99", time.Now())
+	if !ok || site.RoomName(c) != "Exam299" {
+		t.Fail()
+	}
+
+	// Unknown virtual states are rejected
+	cfg = strings.Replace(cfg, `{"name": "Checkin", "category": "virtual"}`, `{"name": "Waiting", "category": "virtual"}`, 1)
+	if _, err := ReadSiteConfig(strings.NewReader(cfg)); err == nil {
+		t.Fail()
+	}
+}
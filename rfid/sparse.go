@@ -0,0 +1,73 @@
+package rfid
+
+// edge is a transition to or from a state with nonzero probability.
+type edge struct {
+	state int
+	prob  float64
+}
+
+// SparseTrans is a transition probability matrix that only stores the nonzero
+// probabilities, so that HMM computations take time proportional to the number
+// of possible transitions rather than the square of the number of states.
+type SparseTrans struct {
+
+	// The number of states
+	n int
+
+	// in[j] holds the states that can move to state j, in increasing order
+	in [][]edge
+
+	// out[j] holds the states that can be reached from state j, in increasing order
+	out [][]edge
+}
+
+// NewSparseTrans returns a sparse version of a transition probability matrix.
+func NewSparseTrans(trans [][]float64) *SparseTrans {
+
+	n := len(trans)
+	st := &SparseTrans{
+		n:   n,
+		in:  make([][]edge, n),
+		out: make([][]edge, n),
+	}
+
+	for j := 0; j < n; j++ {
+		for k, p := range trans[j] {
+			if p != 0 {
+				st.out[j] = append(st.out[j], edge{k, p})
+				st.in[k] = append(st.in[k], edge{j, p})
+			}
+		}
+	}
+
+	return st
+}
+
+// NumStates returns the number of states.
+func (st *SparseTrans) NumStates() int {
+	return st.n
+}
+
+// NumEdges returns the number of transitions with nonzero probability.
+func (st *SparseTrans) NumEdges() int {
+
+	var m int
+	for _, e := range st.out {
+		m += len(e)
+	}
+
+	return m
+}
+
+// Dense returns the transition probabilities as a square matrix.
+func (st *SparseTrans) Dense() [][]float64 {
+
+	trans := alloc(st.n, st.n)
+	for j, out := range st.out {
+		for _, e := range out {
+			trans[j][e.state] = e.prob
+		}
+	}
+
+	return trans
+}
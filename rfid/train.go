@@ -0,0 +1,246 @@
+package rfid
+
+import (
+	"fmt"
+	"math"
+)
+
+// TrainOptions controls the Baum-Welch estimation of the HMM parameters.
+type TrainOptions struct {
+
+	// The maximum number of EM iterations
+	MaxIter int
+
+	// Stop when the log-likelihood increases by less than this amount
+	Tol float64
+
+	// A pseudo-count added to the expected counts for every parameter
+	// that is not a structural zero
+	Prior float64
+
+	// If not nil, called after each iteration with the iteration number
+	// (starting at 1) and the log-likelihood of the data at the start
+	// of the iteration
+	Report func(iter int, loglik float64)
+}
+
+// Train estimates the start, transition and emission probabilities from a collection
+// of sequences, using the Baum-Welch (EM) algorithm started from the current parameter
+// values.  Parameters that are zero at the start are structural zeros, and remain zero,
+// so constraints such as forbidden transitions are preserved.  The log-likelihood of
+// the data at the start of each iteration is returned.  On success the HMM holds the
+// estimated parameters, and the data must be set again before calling Fit.  Only
+// discrete observations are used, any likelihood set with SetLikelihood is ignored.
+func (hmm *HMM) Train(seqs [][]int, opts TrainOptions) ([]float64, error) {
+
+	tr := NewTrainer(hmm, opts)
+	for !tr.Done() {
+		for i, seq := range seqs {
+			if err := tr.Add(seq); err != nil {
+				return tr.LogLik(), fmt.Errorf("sequence %d: %w", i, err)
+			}
+		}
+		tr.Step()
+	}
+
+	return tr.LogLik(), nil
+}
+
+// Trainer runs the Baum-Welch algorithm of HMM.Train with the sequences given one at
+// a time, so that they don't all need to be held in memory.  In each iteration, every
+// sequence is passed to Add, and then Step updates the parameters.
+type Trainer struct {
+	hmm  *HMM
+	opts TrainOptions
+
+	// The current parameter estimates
+	start []float64
+	trans [][]float64
+	emis  [][]float64
+
+	// The expected counts and log-likelihood of the sequences added in this iteration
+	cstart []float64
+	ctrans [][]float64
+	cemis  [][]float64
+	loglik float64
+	nseq   int
+
+	logliks []float64
+	done    bool
+}
+
+// NewTrainer returns a Trainer that starts from the parameters of hmm, and stores the
+// estimates in hmm when it is done.
+func NewTrainer(hmm *HMM, opts TrainOptions) *Trainer {
+
+	nState := len(hmm.emis)
+	nObs := len(hmm.emis[0])
+
+	return &Trainer{
+		hmm:    hmm,
+		opts:   opts,
+		start:  append([]float64(nil), hmm.start...),
+		trans:  copymat(hmm.Transmission()),
+		emis:   copymat(hmm.emis),
+		cstart: make([]float64, nState),
+		ctrans: alloc(nState, nState),
+		cemis:  alloc(nState, nObs),
+		done:   opts.MaxIter <= 0,
+	}
+}
+
+// Add adds the expected counts for one sequence under the current estimates.  An
+// error wrapping ErrDegenerateHMM is returned if the sequence has zero probability,
+// in which case nothing is added.
+func (tr *Trainer) Add(seq []int) error {
+
+	h := &HMM{start: tr.start, trans: tr.trans, emis: tr.emis, data: seq}
+	if err := h.Fit(); err != nil {
+		return err
+	}
+	tr.loglik += h.LogLik
+	tr.nseq++
+
+	h.addCounts(tr.cstart, tr.ctrans, tr.cemis)
+
+	return nil
+}
+
+// Step finishes an iteration, updating the estimates from the sequences added since
+// the last step.  Training is done after opts.MaxIter iterations, when the
+// log-likelihood increases by less than opts.Tol, or after an iteration with no
+// sequences, which leaves the estimates unchanged.
+func (tr *Trainer) Step() {
+
+	if tr.done {
+		return
+	}
+	if tr.nseq == 0 {
+		tr.finish()
+		return
+	}
+
+	iter := len(tr.logliks) + 1
+	tr.logliks = append(tr.logliks, tr.loglik)
+	if tr.opts.Report != nil {
+		tr.opts.Report(iter, tr.loglik)
+	}
+
+	// M-step
+	mstep(tr.start, tr.cstart, tr.opts.Prior)
+	for j := range tr.trans {
+		mstep(tr.trans[j], tr.ctrans[j], tr.opts.Prior)
+		mstep(tr.emis[j], tr.cemis[j], tr.opts.Prior)
+	}
+
+	if iter >= tr.opts.MaxIter || (iter > 1 && tr.loglik-tr.logliks[iter-2] < tr.opts.Tol) {
+		tr.finish()
+		return
+	}
+
+	// Start the next iteration
+	zero(tr.cstart)
+	for j := range tr.trans {
+		zero(tr.ctrans[j])
+		zero(tr.cemis[j])
+	}
+	tr.loglik = 0
+	tr.nseq = 0
+}
+
+// finish stores the estimates in the HMM.
+func (tr *Trainer) finish() {
+
+	tr.done = true
+	tr.hmm.start = tr.start
+	tr.hmm.trans = tr.trans
+	tr.hmm.emis = tr.emis
+	if tr.hmm.strans != nil {
+		tr.hmm.strans = NewSparseTrans(tr.trans)
+	}
+}
+
+// Done returns true when training is finished, and the HMM holds the estimates.
+func (tr *Trainer) Done() bool {
+	return tr.done
+}
+
+// HMM returns the HMM being trained.
+func (tr *Trainer) HMM() *HMM {
+	return tr.hmm
+}
+
+// LogLik returns the log-likelihood of the data at the start of each iteration so far.
+func (tr *Trainer) LogLik() []float64 {
+	return tr.logliks
+}
+
+// zero sets every element of x to 0.
+func zero(x []float64) {
+	for i := range x {
+		x[i] = 0
+	}
+}
+
+// addCounts adds the expected number of starts in each state, transitions between
+// each pair of states, and emissions of each value from each state to the given
+// arrays.  Fit must have been called.
+func (hmm *HMM) addCounts(cstart []float64, ctrans, cemis [][]float64) {
+
+	for j := 0; j < hmm.nState; j++ {
+		cstart[j] += hmm.PostProb[0][j]
+	}
+
+	for t := 0; t < hmm.nTime; t++ {
+		for j := 0; j < hmm.nState; j++ {
+			cemis[j][hmm.data[t]] += hmm.PostProb[t][j]
+		}
+	}
+
+	// Expected transitions, using the scaled forward and backward probabilities
+	for t := 0; t < hmm.nTime-1; t++ {
+		for j := 0; j < hmm.nState; j++ {
+			f := hmm.fprob[t][j]
+			if f == 0 {
+				continue
+			}
+			for k := 0; k < hmm.nState; k++ {
+				ctrans[j][k] += f * hmm.trans[j][k] * hmm.emis[k][hmm.data[t+1]] * hmm.bprob[t+1][k] / hmm.scale[t+1]
+			}
+		}
+	}
+}
+
+// mstep replaces the probabilities in p with the normalized expected counts.
+// Structural zeros in p are kept.  If there are no counts, p is not changed.
+func mstep(p, counts []float64, prior float64) {
+
+	var tot float64
+	for j := range p {
+		if p[j] == 0 {
+			counts[j] = 0
+			continue
+		}
+		counts[j] += prior
+		tot += counts[j]
+	}
+
+	if tot == 0 || math.IsNaN(tot) {
+		return
+	}
+
+	for j := range p {
+		p[j] = counts[j] / tot
+	}
+}
+
+// copymat returns a copy of a matrix.
+func copymat(x [][]float64) [][]float64 {
+
+	y := make([][]float64, len(x))
+	for i := range x {
+		y[i] = append([]float64(nil), x[i]...)
+	}
+
+	return y
+}
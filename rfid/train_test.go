@@ -0,0 +1,164 @@
+package rfid
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// simulate generates a state sequence and data from an HMM.
+func simulate(rng *rand.Rand, emis, trans [][]float64, start []float64, n int) ([]int, []int) {
+
+	draw := func(p []float64) int {
+		u := rng.Float64()
+		for j, q := range p {
+			if u < q {
+				return j
+			}
+			u -= q
+		}
+		return len(p) - 1
+	}
+
+	states := make([]int, n)
+	data := make([]int, n)
+	states[0] = draw(start)
+	data[0] = draw(emis[states[0]])
+	for i := 1; i < n; i++ {
+		states[i] = draw(trans[states[i-1]])
+		data[i] = draw(emis[states[i]])
+	}
+
+	return states, data
+}
+
+func TestTrain(t *testing.T) {
+
+	emis := [][]float64{
+		[]float64{0.8, 0.1, 0.1},
+		[]float64{0.1, 0.8, 0.1},
+		[]float64{0.1, 0.1, 0.8},
+	}
+
+	// State 2 is absorbing, and state 0 can't be reached from state 1.
+	trans := [][]float64{
+		[]float64{0.9, 0.08, 0.02},
+		[]float64{0, 0.85, 0.15},
+		[]float64{0, 0, 1},
+	}
+	start := []float64{0.7, 0.3, 0}
+
+	rng := rand.New(rand.NewSource(1))
+	var seqs [][]int
+	for i := 0; i < 300; i++ {
+		_, data := simulate(rng, emis, trans, start, 60)
+		seqs = append(seqs, data)
+	}
+
+	// Start from rough values that have the same structural zeros
+	hmm := HMM{}
+	hmm.SetEmission([][]float64{
+		[]float64{0.6, 0.2, 0.2},
+		[]float64{0.2, 0.6, 0.2},
+		[]float64{0.2, 0.2, 0.6},
+	})
+	hmm.SetTransmission([][]float64{
+		[]float64{0.8, 0.1, 0.1},
+		[]float64{0, 0.8, 0.2},
+		[]float64{0, 0, 1},
+	})
+	hmm.SetStart([]float64{0.5, 0.5, 0})
+
+	var reported int
+	ll, err := hmm.Train(seqs, TrainOptions{MaxIter: 200, Tol: 1e-6, Report: func(int, float64) { reported++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reported != len(ll) {
+		t.Errorf("reported %d iterations, expected %d", reported, len(ll))
+	}
+
+	// EM never decreases the log-likelihood
+	for i := 1; i < len(ll); i++ {
+		if ll[i] < ll[i-1]-1e-8 {
+			t.Errorf("log-likelihood decreased at iteration %d: %f < %f", i+1, ll[i], ll[i-1])
+		}
+	}
+
+	// Structural zeros are preserved
+	if hmm.Transmission()[1][0] != 0 || hmm.Transmission()[2][0] != 0 || hmm.Transmission()[2][1] != 0 || hmm.Start()[2] != 0 {
+		t.Errorf("structural zeros not preserved: %v %v", hmm.Transmission(), hmm.Start())
+	}
+
+	for j := range trans {
+		for k := range trans[j] {
+			if math.Abs(hmm.Transmission()[j][k]-trans[j][k]) > 0.05 {
+				t.Errorf("transition %d,%d estimated as %f, expected %f", j, k, hmm.Transmission()[j][k], trans[j][k])
+			}
+			if math.Abs(hmm.Emission()[j][k]-emis[j][k]) > 0.05 {
+				t.Errorf("emission %d,%d estimated as %f, expected %f", j, k, hmm.Emission()[j][k], emis[j][k])
+			}
+		}
+	}
+}
+
+// Sequences with zero probability are left out, and an iteration with no sequences
+// ends training without changing the parameters.
+func TestTrainer(t *testing.T) {
+
+	hmm := HMM{}
+	hmm.SetEmission([][]float64{
+		[]float64{0.9, 0.1},
+		[]float64{0.2, 0.8},
+	})
+	hmm.SetTransmission([][]float64{
+		[]float64{0.9, 0.1},
+		[]float64{0, 1},
+	})
+	hmm.SetStart([]float64{1, 0})
+
+	tr := NewTrainer(&hmm, TrainOptions{MaxIter: 10, Tol: 1e-6})
+	if err := tr.Add([]int{0, 0, 1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Done() {
+		t.Fatal("trainer finished before any step")
+	}
+	tr.Step()
+	if len(tr.LogLik()) != 1 {
+		t.Errorf("got %d log-likelihoods after one step", len(tr.LogLik()))
+	}
+
+	tr.Step()
+	if !tr.Done() {
+		t.Errorf("trainer not finished after an iteration with no sequences")
+	}
+	if len(tr.LogLik()) != 1 {
+		t.Errorf("empty iteration was counted")
+	}
+	if hmm.Transmission()[1][0] != 0 {
+		t.Errorf("structural zero not preserved")
+	}
+
+	// A sequence that starts in the second state has zero probability
+	deg := HMM{}
+	deg.SetEmission([][]float64{
+		[]float64{1, 0},
+		[]float64{0, 1},
+	})
+	deg.SetTransmission([][]float64{
+		[]float64{0.5, 0.5},
+		[]float64{0, 1},
+	})
+	deg.SetStart([]float64{1, 0})
+	tr = NewTrainer(&deg, TrainOptions{MaxIter: 10})
+	if err := tr.Add([]int{1, 1}); !errors.Is(err, ErrDegenerateHMM) {
+		t.Errorf("expected ErrDegenerateHMM, got %v", err)
+	}
+	tr.Step()
+	if !tr.Done() || deg.Start()[0] != 1 {
+		t.Errorf("parameters changed by a sequence with zero probability")
+	}
+}
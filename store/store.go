@@ -0,0 +1,451 @@
+// Package store holds location records on disk, partitioned by site and day, with an
+// index giving the partitions that contain each CSN, UMid and tag id.  The locations
+// for one site and day are in the file site/YYYY/MM/DD.gob.gz below the store
+// directory, sorted by tag id and time, and the index is in index.gob.gz.
+package store
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kshedden/rfid/rfid"
+)
+
+// IndexVersion is the version of the index format written by this package.  Stores
+// with other versions are rejected.
+const IndexVersion = 1
+
+// indexName is the name of the index file in the store directory.
+const indexName = "index.gob.gz"
+
+// Partition identifies the locations for one site and day.
+type Partition struct {
+	Site string
+	Day  time.Time
+}
+
+// before orders partitions by day and then by site.
+func (p Partition) before(q Partition) bool {
+
+	if !p.Day.Equal(q.Day) {
+		return p.Day.Before(q.Day)
+	}
+
+	return p.Site < q.Site
+}
+
+// String returns the path of the partition relative to the store directory.
+func (p Partition) String() string {
+	return path.Join(p.Site, p.Day.Format("2006/01/02")+".gob.gz")
+}
+
+// SortPartitions sorts partitions by day and then by site.
+func SortPartitions(parts []Partition) {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].before(parts[j]) })
+}
+
+// indexEntry gives the partitions, as positions in the list of partitions, that
+// contain one identifier.
+type indexEntry struct {
+	ID    uint64
+	Parts []int
+}
+
+// index is the form of the index on disk.  The entries are sorted by identifier so
+// that the index file is the same every time the same locations are written.
+type index struct {
+	Version int
+	Parts   []Partition
+	Counts  []int
+	CSN     []indexEntry
+	UMid    []indexEntry
+	TagId   []indexEntry
+}
+
+// Store reads the locations in a store directory.
+type Store struct {
+	dir    string
+	parts  []Partition
+	counts map[Partition]int
+	csn    map[uint64][]int
+	umid   map[uint64][]int
+	tagid  map[uint64][]int
+}
+
+// Open opens the store in dir, reading its index.
+func Open(dir string) (*Store, error) {
+
+	fname := path.Join(dir, indexName)
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	defer gid.Close()
+
+	var idx index
+	if err := gob.NewDecoder(gid).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+	if idx.Version != IndexVersion {
+		return nil, fmt.Errorf("%s: index version %d is not supported (expected %d)", fname, idx.Version, IndexVersion)
+	}
+	if len(idx.Counts) != len(idx.Parts) {
+		return nil, fmt.Errorf("%s: %d partitions but %d counts", fname, len(idx.Parts), len(idx.Counts))
+	}
+
+	s := &Store{
+		dir:    dir,
+		parts:  idx.Parts,
+		counts: make(map[Partition]int),
+		csn:    makeLookup(idx.CSN),
+		umid:   makeLookup(idx.UMid),
+		tagid:  makeLookup(idx.TagId),
+	}
+	for i, p := range idx.Parts {
+		s.counts[p] = idx.Counts[i]
+	}
+
+	return s, nil
+}
+
+// makeLookup returns a map from each identifier in the index entries to its partitions.
+func makeLookup(entries []indexEntry) map[uint64][]int {
+
+	m := make(map[uint64][]int, len(entries))
+	for _, e := range entries {
+		m[e.ID] = e.Parts
+	}
+
+	return m
+}
+
+// Partitions returns the partitions in the store, sorted by day and then by site.
+func (s *Store) Partitions() []Partition {
+	return append([]Partition(nil), s.parts...)
+}
+
+// Count returns the number of locations in a partition, which is zero if the
+// partition is not in the store.
+func (s *Store) Count(p Partition) int {
+	return s.counts[p]
+}
+
+// OpenPartition returns a reader for the locations in one partition.  If the
+// partition is not in the store the reader returns no locations.
+func (s *Store) OpenPartition(p Partition) (*Reader, error) {
+
+	if _, ok := s.counts[p]; !ok {
+		return &Reader{}, nil
+	}
+
+	return openReader(path.Join(s.dir, p.String()))
+}
+
+// Read returns all the locations in one partition, sorted by tag id and time.
+func (s *Store) Read(p Partition) ([]*rfid.Location, error) {
+
+	r, err := s.OpenPartition(p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var locs []*rfid.Location
+	for {
+		loc, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		locs = append(locs, loc)
+	}
+
+	return locs, nil
+}
+
+// ByCSN returns the locations with the given CSN, reading only the partitions that
+// contain it.
+func (s *Store) ByCSN(csn uint64) ([]*rfid.Location, error) {
+	return s.lookup(s.csn[csn], func(loc *rfid.Location) bool { return loc.CSN == csn })
+}
+
+// ByUMid returns the locations with the given UMid, reading only the partitions that
+// contain it.
+func (s *Store) ByUMid(umid uint64) ([]*rfid.Location, error) {
+	return s.lookup(s.umid[umid], func(loc *rfid.Location) bool { return loc.UMid == umid })
+}
+
+// ByTagId returns the locations with the given tag id, reading only the partitions that
+// contain it.
+func (s *Store) ByTagId(tagid uint64) ([]*rfid.Location, error) {
+	return s.lookup(s.tagid[tagid], func(loc *rfid.Location) bool { return loc.TagId == tagid })
+}
+
+// lookup returns the locations in the given partitions that are selected by keep, in
+// partition order.
+func (s *Store) lookup(parts []int, keep func(*rfid.Location) bool) ([]*rfid.Location, error) {
+
+	var locs []*rfid.Location
+	for _, i := range parts {
+
+		r, err := s.OpenPartition(s.parts[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			loc, err := r.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				r.Close()
+				return nil, err
+			}
+			if keep(loc) {
+				locs = append(locs, loc)
+			}
+		}
+		r.Close()
+	}
+
+	return locs, nil
+}
+
+// Reader reads the locations in a partition one at a time.
+type Reader struct {
+	fname string
+	fid   *os.File
+	gid   *gzip.Reader
+	dec   *gob.Decoder
+	n     int
+}
+
+// openReader returns a reader for the locations in a gzipped gob file.
+func openReader(fname string) (*Reader, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	gid, err := gzip.NewReader(fid)
+	if err != nil {
+		fid.Close()
+		return nil, fmt.Errorf("%s: %w", fname, err)
+	}
+
+	return &Reader{fname: fname, fid: fid, gid: gid, dec: gob.NewDecoder(gid)}, nil
+}
+
+// Next returns the next location, or io.EOF after the last one.
+func (r *Reader) Next() (*rfid.Location, error) {
+
+	if r.dec == nil {
+		return nil, io.EOF
+	}
+
+	loc := new(rfid.Location)
+	if err := r.dec.Decode(loc); err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: record %d: %w", r.fname, r.n+1, err)
+	}
+	r.n++
+
+	return loc, nil
+}
+
+// Close closes the file.
+func (r *Reader) Close() error {
+
+	if r.fid == nil {
+		return nil
+	}
+	r.gid.Close()
+
+	return r.fid.Close()
+}
+
+// Writer writes the locations for a new store, one partition at a time.  The index
+// is written by Close, and the store can't be opened until then.
+type Writer struct {
+	dir    string
+	parts  []Partition
+	counts map[Partition]int
+	csn    map[uint64][]int
+	umid   map[uint64][]int
+	tagid  map[uint64][]int
+}
+
+// Create returns a writer for a new store in dir, removing any store that is
+// already there.
+func Create(dir string) (*Writer, error) {
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		dir:    dir,
+		counts: make(map[Partition]int),
+		csn:    make(map[uint64][]int),
+		umid:   make(map[uint64][]int),
+		tagid:  make(map[uint64][]int),
+	}
+
+	return w, nil
+}
+
+// Write sorts the locations for one site and day by tag id and time, and writes them
+// as a partition of the store.  Nothing is written if there are no locations.  Each
+// partition can only be written once.
+func (w *Writer) Write(site string, day time.Time, locs []*rfid.Location) error {
+
+	if len(locs) == 0 {
+		return nil
+	}
+
+	if site == "" || site == "." || site == ".." || strings.ContainsAny(site, `/\`) {
+		return fmt.Errorf("site name '%s' can't be used in a file name", site)
+	}
+	y, m, d := day.Date()
+	p := Partition{Site: site, Day: time.Date(y, m, d, 0, 0, 0, 0, time.UTC)}
+	if _, ok := w.counts[p]; ok {
+		return fmt.Errorf("partition %s was already written", p)
+	}
+
+	rfid.SortLocations(locs)
+
+	fname := path.Join(w.dir, p.String())
+	if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+		return err
+	}
+	if err := writeLocations(fname, locs); err != nil {
+		return err
+	}
+
+	i := len(w.parts)
+	w.parts = append(w.parts, p)
+	w.counts[p] = len(locs)
+
+	add := func(m map[uint64][]int, id uint64) {
+		if ix := m[id]; len(ix) == 0 || ix[len(ix)-1] != i {
+			m[id] = append(ix, i)
+		}
+	}
+	for _, loc := range locs {
+		add(w.csn, loc.CSN)
+		add(w.umid, loc.UMid)
+		add(w.tagid, loc.TagId)
+	}
+
+	return nil
+}
+
+// writeLocations writes location records to a gzipped gob file.
+func writeLocations(fname string, locs []*rfid.Location) error {
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	gid := gzip.NewWriter(fid)
+	enc := gob.NewEncoder(gid)
+
+	for _, r := range locs {
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("%s: %w", fname, err)
+		}
+	}
+
+	if err := gid.Close(); err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+
+	return fid.Close()
+}
+
+// Close writes the index of the store.  The partitions in the index are sorted by
+// day and then by site, whatever order they were written in.
+func (w *Writer) Close() error {
+
+	// The position of each partition in sorted order
+	order := make([]int, len(w.parts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return w.parts[order[i]].before(w.parts[order[j]]) })
+	pos := make([]int, len(w.parts))
+	for j, i := range order {
+		pos[i] = j
+	}
+
+	idx := index{Version: IndexVersion}
+	for _, i := range order {
+		idx.Parts = append(idx.Parts, w.parts[i])
+		idx.Counts = append(idx.Counts, w.counts[w.parts[i]])
+	}
+	idx.CSN = makeEntries(w.csn, pos)
+	idx.UMid = makeEntries(w.umid, pos)
+	idx.TagId = makeEntries(w.tagid, pos)
+
+	fname := path.Join(w.dir, indexName)
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	gid := gzip.NewWriter(fid)
+	if err := gob.NewEncoder(gid).Encode(&idx); err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+	if err := gid.Close(); err != nil {
+		return fmt.Errorf("%s: %w", fname, err)
+	}
+
+	return fid.Close()
+}
+
+// Abort removes a store that can't be completed, with the partitions written so far.
+// The writer can't be used afterwards.
+func (w *Writer) Abort() error {
+	return os.RemoveAll(w.dir)
+}
+
+// makeEntries returns the index entries for the identifiers in m sorted by identifier,
+// with the partitions renumbered by pos and sorted.
+func makeEntries(m map[uint64][]int, pos []int) []indexEntry {
+
+	entries := make([]indexEntry, 0, len(m))
+	for id, ix := range m {
+		parts := make([]int, len(ix))
+		for j, i := range ix {
+			parts[j] = pos[i]
+		}
+		sort.Ints(parts)
+		entries = append(entries, indexEntry{ID: id, Parts: parts})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	return entries
+}
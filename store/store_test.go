@@ -0,0 +1,167 @@
+package store
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kshedden/rfid/rfid"
+)
+
+// testLocations returns locations for two tags over a few minutes of a day, in
+// reverse time order.
+func testLocations(site string, day time.Time, csn uint64) []*rfid.Location {
+
+	var locs []*rfid.Location
+	for m := 5; m >= 0; m-- {
+		for tag := uint64(1); tag <= 2; tag++ {
+			locs = append(locs, &rfid.Location{Site: site, TagId: tag, CSN: csn + tag, UMid: 0,
+				TimeStamp: day.Add(time.Duration(8*60+m) * time.Minute), PersonCat: rfid.Patient})
+		}
+	}
+
+	return locs
+}
+
+func TestStore(t *testing.T) {
+
+	dir := path.Join(t.TempDir(), "locations")
+	d1 := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	d2 := time.Date(2018, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	w, err := Create(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written out of order
+	for _, x := range []struct {
+		site string
+		day  time.Time
+		csn  uint64
+	}{
+		{"north", d2, 200},
+		{"main", d2, 100},
+		{"main", d1, 100},
+	} {
+		if err := w.Write(x.site, x.day, testLocations(x.site, x.day, x.csn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write("main", d1.Add(9*time.Hour), testLocations("main", d1, 100)); err == nil {
+		t.Errorf("partition was written twice")
+	}
+	if err := w.Write("a/b", d1, testLocations("a/b", d1, 100)); err == nil {
+		t.Errorf("site name with a separator was accepted")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "main", "2018", "03", "02.gob.gz")); err != nil {
+		t.Errorf("partition file is missing: %v", err)
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := s.Partitions()
+	expected := []Partition{{"main", d1}, {"main", d2}, {"north", d2}}
+	if !reflect.DeepEqual(parts, expected) {
+		t.Fatalf("got partitions %v, expected %v", parts, expected)
+	}
+
+	locs, err := s.Read(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 12 || s.Count(parts[1]) != 12 {
+		t.Fatalf("got %d locations, count %d, expected 12", len(locs), s.Count(parts[1]))
+	}
+	for i := 1; i < len(locs); i++ {
+		a, b := locs[i-1], locs[i]
+		if a.TagId > b.TagId || (a.TagId == b.TagId && !a.TimeStamp.Before(b.TimeStamp)) {
+			t.Fatalf("locations are not sorted by tag id and time at %d", i)
+		}
+	}
+
+	// A partition that is not in the store has no locations
+	if locs, err := s.Read(Partition{"north", d1}); err != nil || len(locs) != 0 {
+		t.Errorf("got %d locations from a missing partition: %v", len(locs), err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		lookup func(uint64) ([]*rfid.Location, error)
+		id     uint64
+		n      int
+	}{
+		{"CSN", s.ByCSN, 101, 12},
+		{"CSN", s.ByCSN, 202, 6},
+		{"CSN", s.ByCSN, 999, 0},
+		{"UMid", s.ByUMid, 0, 36},
+		{"TagId", s.ByTagId, 2, 18},
+	} {
+		locs, err := c.lookup(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locs) != c.n {
+			t.Errorf("%s %d: got %d locations, expected %d", c.name, c.id, len(locs), c.n)
+		}
+	}
+
+	// The index is the same when the partitions are written in another order
+	w, err = Create(path.Join(t.TempDir(), "locations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range expected {
+		csn := uint64(100)
+		if p.Site == "north" {
+			csn = 200
+		}
+		if err := w.Write(p.Site, p.Day, testLocations(p.Site, p.Day, csn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b1, err := os.ReadFile(path.Join(dir, indexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := os.ReadFile(path.Join(w.dir, indexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b1) != string(b2) {
+		t.Errorf("index depends on the order the partitions were written")
+	}
+}
+
+func TestAbort(t *testing.T) {
+
+	dir := path.Join(t.TempDir(), "locations")
+	day := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	w, err := Create(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write("main", day, testLocations("main", day, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("store directory was not removed: %v", err)
+	}
+}